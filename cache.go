@@ -1,12 +1,26 @@
 package cache2go
 
 import (
+    "log"
+    "sort"
+    "strings"
     "sync"
+    "time"
 )
 
 var (
     cache = make(map[string]*CacheTable)
     mutex sync.RWMutex
+    //预先注册的 loadData 回调函数，缓存表创建时自动设置，由 mutex 保护
+    loaders = make(map[string]func(key interface{}, args ...interface{}) *CacheItem)
+    //缓存表创建和删除时的回调函数，由 mutex 保护
+    tableLifecycle func(event string, name string)
+)
+
+//缓存表生命周期回调函数收到的事件
+const (
+    TableCreated = "created"
+    TableDeleted = "deleted"
 )
 /*
  * 我们第一步一般都是调用上面的Cache函数创建缓存，该函数会检查一个全局变量cache（该变量是一个map，其值类型为*CacheTable，key是缓存表的名字）
@@ -19,16 +33,208 @@ func Cache(table string) *CacheTable {
     t, ok := cache[table]
     mutex.RUnlock()
     if !ok {
+        created := false
         mutex.Lock()
         t, ok = cache[table]
         if !ok {
-            t := &CacheTable {
+            t = &CacheTable {
                 name: table,
                 items: make(map[interface{}]*CacheItem),
+                loadData: loaders[table],
             }
             cache[table] = t
+            created = true
         }
+        lifecycle := tableLifecycle
         mutex.Unlock()
+        //在包锁之外执行回调函数
+        if created && lifecycle != nil {
+            lifecycle(TableCreated, table)
+        }
+    }
+    return t
+}
+
+//创建缓存表时使用的配置模板，零值的字段不设置
+type TableTemplate struct {
+    Logger             *log.Logger
+    KeyStringer        func(key interface{}) string
+    MinCleanupInterval time.Duration
+    ExpirationPolicy   ExpirationPolicy
+    SoftDeleteWindow   time.Duration
+    MaxAnalysisItems   int
+    Capacity           int
+    EvictionPolicy     EvictionPolicy
+    MutationLogSize    int
+    AccessHistorySize  int
+    DataLoader         func(key interface{}, args ...interface{}) *CacheItem
+    DefaultLoaderArgs  []interface{}
+    AddedItem          func(item *CacheItem)
+    AboutToDeleteItem  func(item *CacheItem)
+    //为 true 时缓存表已经存在也应用模板，否则只应用到新创建的缓存表
+    ApplyToExisting    bool
+}
+
+//获取缓存表，缓存表是新创建的（或模板设置了 ApplyToExisting）时按模板设置
+func CacheFrom(table string, tmpl TableTemplate) *CacheTable {
+    mutex.RLock()
+    _, existed := cache[table]
+    mutex.RUnlock()
+    t := Cache(table)
+    if existed && !tmpl.ApplyToExisting {
+        return t
+    }
+    if tmpl.Logger != nil {
+        t.SetLogger(tmpl.Logger)
+    }
+    if tmpl.KeyStringer != nil {
+        t.SetKeyStringer(tmpl.KeyStringer)
+    }
+    if tmpl.MinCleanupInterval != 0 {
+        t.SetMinCleanupInterval(tmpl.MinCleanupInterval)
+    }
+    if tmpl.ExpirationPolicy != ExpireSliding {
+        t.SetExpirationPolicy(tmpl.ExpirationPolicy)
+    }
+    if tmpl.SoftDeleteWindow != 0 {
+        t.SetSoftDeleteWindow(tmpl.SoftDeleteWindow)
+    }
+    if tmpl.Capacity != 0 {
+        t.SetCapacity(tmpl.Capacity)
+    }
+    if tmpl.EvictionPolicy != EvictLRU {
+        t.SetEvictionPolicy(tmpl.EvictionPolicy)
+    }
+    if tmpl.MaxAnalysisItems != 0 {
+        t.SetMaxAnalysisItems(tmpl.MaxAnalysisItems)
+    }
+    if tmpl.MutationLogSize != 0 {
+        t.SetMutationLogSize(tmpl.MutationLogSize)
+    }
+    if tmpl.AccessHistorySize != 0 {
+        t.SetAccessHistorySize(tmpl.AccessHistorySize)
+    }
+    if tmpl.DataLoader != nil {
+        t.SetDataLoader(tmpl.DataLoader)
+    }
+    if tmpl.DefaultLoaderArgs != nil {
+        t.SetDefaultLoaderArgs(tmpl.DefaultLoaderArgs...)
+    }
+    if tmpl.AddedItem != nil {
+        t.SetAddedItemCallback(tmpl.AddedItem)
+    }
+    if tmpl.AboutToDeleteItem != nil {
+        t.SetAboutToDeleteItemCallback(tmpl.AboutToDeleteItem)
     }
     return t
-}
\ No newline at end of file
+}
+
+//为名字为 table 的缓存表预先注册 loadData 回调函数，缓存表第一次创建时自动设置
+//对已经存在的缓存表不生效，需要调用缓存表的 SetDataLoader
+func RegisterLoader(table string, f func(interface{}, ...interface{}) *CacheItem) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    loaders[table] = f
+}
+
+//设置缓存表创建和删除时的回调函数，event 为 TableCreated 或 TableDeleted
+func SetTableLifecycleCallback(f func(event string, name string)) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    tableLifecycle = f
+}
+
+//从全局变量cache中删除缓存表，返回缓存表是否存在
+func DeleteTable(table string) bool {
+    mutex.Lock()
+    t, ok := cache[table]
+    delete(cache, table)
+    lifecycle := tableLifecycle
+    mutex.Unlock()
+    if !ok {
+        return false
+    }
+    t.stopCleanup()
+    if lifecycle != nil {
+        lifecycle(TableDeleted, table)
+    }
+    return true
+}
+
+//返回所有缓存表的名字和缓存记录条数
+func TablesSummary() map[string]int {
+    mutex.RLock()
+    tables := make(map[string]*CacheTable, len(cache))
+    for name, t := range cache {
+        tables[name] = t
+    }
+    mutex.RUnlock()
+    //在包锁之外统计，缓存表期间被删除也不影响
+    r := make(map[string]int, len(tables))
+    for name, t := range tables {
+        r[name] = t.Count()
+    }
+    return r
+}
+
+//同时复制多个缓存表的缓存记录，不存在的缓存表被忽略
+//按名字顺序对所有缓存表加读锁后再一起复制，避免死锁并尽量减少各表之间的时间差
+//加锁不是原子的，不能保证严格的跨表一致性
+func SnapshotTables(names ...string) map[string]map[interface{}]*CacheItem {
+    sorted := append([]string(nil), names...)
+    sort.Strings(sorted)
+    mutex.RLock()
+    var tables []*CacheTable
+    for i, name := range sorted {
+        if i > 0 && name == sorted[i-1] {
+            continue
+        }
+        if t, ok := cache[name]; ok {
+            tables = append(tables, t)
+        }
+    }
+    mutex.RUnlock()
+
+    for _, t := range tables {
+        t.RLock()
+    }
+    r := make(map[string]map[interface{}]*CacheItem, len(tables))
+    for _, t := range tables {
+        items := make(map[interface{}]*CacheItem, len(t.items))
+        for key, item := range t.items {
+            items[key] = item
+        }
+        r[t.name] = items
+    }
+    for _, t := range tables {
+        t.RUnlock()
+    }
+    return r
+}
+
+//按层级路径获取缓存表，路径各段用 "." 连接作为缓存表的名字，不存在时创建
+func CacheNamespace(path ...string) *CacheTable {
+    return Cache(strings.Join(path, "."))
+}
+
+//删除路径前缀下的所有缓存表（包括前缀本身对应的缓存表），返回删除的缓存表数量
+func DeleteNamespace(prefix ...string) int {
+    name := strings.Join(prefix, ".")
+    mutex.Lock()
+    var removed []*CacheTable
+    for n, t := range cache {
+        if n == name || strings.HasPrefix(n, name+".") {
+            delete(cache, n)
+            removed = append(removed, t)
+        }
+    }
+    lifecycle := tableLifecycle
+    mutex.Unlock()
+    for _, t := range removed {
+        t.stopCleanup()
+        if lifecycle != nil {
+            lifecycle(TableDeleted, t.name)
+        }
+    }
+    return len(removed)
+}
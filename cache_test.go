@@ -8,11 +8,17 @@
 package cache2go
 
 import (
-	//"bytes"
-	//"log"
-	//"strconv"
-	//"sync"
-	//"sync/atomic"
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -358,3 +364,2343 @@ func TestLogger(t *testing.T) {
 		t.Error("Logger is empty")
 	}
 }*/
+
+func TestAddBatchBulkCallback(t *testing.T) {
+	table := Cache("testAddBatchBulkCallback")
+	added := 0
+	var bulk []*CacheItem
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		added++
+	})
+	table.SetBulkAddedCallback(func(items []*CacheItem) {
+		bulk = items
+	})
+
+	items := []*CacheItem{
+		NewCacheItem(k+"_1", 0, v),
+		NewCacheItem(k+"_2", 0, v),
+		NewCacheItem(k+"_3", 0, v),
+	}
+	table.AddBatch(items)
+
+	// the bulk callback replaces the per-item one
+	if len(bulk) != len(items) {
+		t.Error("Bulk added callback did not receive all items")
+	}
+	if added != 0 {
+		t.Error("Per-item added callback fired despite bulk callback")
+	}
+	if table.Count() != len(items) {
+		t.Error("Error adding batch of items")
+	}
+
+	// without a bulk callback every item is reported individually
+	table.SetBulkAddedCallback(nil)
+	table.AddBatch([]*CacheItem{NewCacheItem(k+"_4", 0, v), NewCacheItem(k+"_5", 0, v)})
+	if added != 2 {
+		t.Error("Per-item added callback not fired for batch")
+	}
+}
+
+func TestDefaultLoaderArgs(t *testing.T) {
+	table := Cache("testDefaultLoaderArgs")
+	var got []interface{}
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		got = args
+		return NewCacheItem(key, 0, v)
+	})
+	table.SetDefaultLoaderArgs("pool", 1)
+
+	// no per-call args, the defaults are supplied
+	table.Value(k + "_1")
+	if len(got) != 2 || got[0] != "pool" || got[1] != 1 {
+		t.Error("Default loader args not supplied", got)
+	}
+
+	// per-call args override the defaults by position
+	table.Value(k+"_2", "other")
+	if len(got) != 2 || got[0] != "other" || got[1] != 1 {
+		t.Error("Per-call loader args did not take precedence", got)
+	}
+}
+
+func TestIncrementBounded(t *testing.T) {
+	table := Cache("testIncrementBounded")
+	table.Add(k, 0, int64(0))
+
+	var finish sync.WaitGroup
+	var m sync.Mutex
+	cappedCount := 0
+	for i := 0; i < 20; i++ {
+		finish.Add(1)
+		go func() {
+			defer finish.Done()
+			n, capped, err := table.IncrementBounded(k, 1, 10)
+			if err != nil || n > 10 {
+				t.Error("Error incrementing bounded counter", n, err)
+			}
+			if capped {
+				m.Lock()
+				cappedCount++
+				m.Unlock()
+			}
+		}()
+	}
+	finish.Wait()
+
+	p, _ := table.Value(k)
+	if p.Data().(int64) != 10 {
+		t.Error("Bounded counter exceeded its maximum")
+	}
+	if cappedCount != 10 {
+		t.Error("Error reporting capped increments", cappedCount)
+	}
+
+	table.Add(k+"_str", 0, v)
+	if _, _, err := table.IncrementBounded(k+"_str", 1, 10); err != ErrNotInteger {
+		t.Error("Expected error incrementing non-integer data")
+	}
+	if _, _, err := table.IncrementBounded(k+"_missing", 1, 10); err != ErrKeyNotFound {
+		t.Error("Expected error incrementing missing key")
+	}
+
+	// an increment past the int64 range is capped instead of wrapping
+	table.Add(k+"_max", 0, int64(math.MaxInt64-1))
+	n, capped, err := table.IncrementBounded(k+"_max", 5, math.MaxInt64)
+	if err != nil || n != math.MaxInt64 || !capped {
+		t.Error("Error capping an overflowing increment", n, capped, err)
+	}
+	table.Add(k+"_min", 0, int64(math.MinInt64+1))
+	if _, _, err := table.IncrementBounded(k+"_min", -5, 0); err != ErrIntegerOverflow {
+		t.Error("Expected overflow error decrementing below int64", err)
+	}
+}
+
+func TestRebirth(t *testing.T) {
+	table := Cache("testRebirth")
+	p := table.Add(k, 100*time.Millisecond, v)
+	created := p.CreatedOn()
+
+	time.Sleep(60 * time.Millisecond)
+	if err := table.Rebirth(k); err != nil {
+		t.Error("Error rebirthing item", err)
+	}
+	if !p.CreatedOn().After(created) {
+		t.Error("Rebirth did not move createdOn forward")
+	}
+
+	// the item gets a full lifespan again after rebirth
+	time.Sleep(60 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item expired despite rebirth")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Error expiring item after rebirth")
+	}
+
+	if table.Rebirth(k) != ErrKeyNotFound {
+		t.Error("Expected error rebirthing missing key")
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	table := Cache("testLockKey")
+
+	var finish sync.WaitGroup
+	var holders [2]int32
+	var overlap int32
+	for i := 0; i < 20; i++ {
+		finish.Add(1)
+		go func(i int) {
+			defer finish.Done()
+			key := i % 2
+			unlock := table.LockKey(key)
+			if atomic.AddInt32(&holders[key], 1) != 1 {
+				t.Error("More than one goroutine holds the same key lock")
+			}
+			// the other key must be able to proceed at the same time
+			if atomic.LoadInt32(&holders[1-key]) == 1 {
+				atomic.StoreInt32(&overlap, 1)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&holders[key], -1)
+			unlock()
+		}(i)
+	}
+	finish.Wait()
+
+	if atomic.LoadInt32(&overlap) == 0 {
+		t.Error("Different key locks did not proceed in parallel")
+	}
+	table.keyLocksMutex.Lock()
+	if len(table.keyLocks) != 0 {
+		t.Error("Key locks not cleaned up after release")
+	}
+	table.keyLocksMutex.Unlock()
+}
+
+func TestKeepAliveSaves(t *testing.T) {
+	table := Cache("testKeepAliveSaves")
+	table.Add(k, 100*time.Millisecond, v)
+
+	// access the item shortly before it would have expired
+	time.Sleep(80 * time.Millisecond)
+	if _, err := table.Value(k); err != nil {
+		t.Error("Error retrieving value from cache", err)
+	}
+
+	// the sweep scheduled for the original deadline finds it refreshed
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Refreshed item expired")
+	}
+	if table.KeepAliveSaves() != 1 {
+		t.Error("Error counting keep-alive saves", table.KeepAliveSaves())
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	a := Cache("testRandSourceA")
+	b := Cache("testRandSourceB")
+	a.SetRandSource(rand.NewSource(42))
+	b.SetRandSource(rand.NewSource(42))
+
+	for i := 0; i < 100; i++ {
+		a.Add(i, 0, v)
+		b.Add(i, 0, v)
+	}
+
+	// identical seeds yield identical samples
+	for i := 0; i < 10; i++ {
+		sa := a.SampleKeys(0.3)
+		sb := b.SampleKeys(0.3)
+		if !reflect.DeepEqual(sa, sb) {
+			t.Error("Tables with identical seeds produced different samples", sa, sb)
+		}
+	}
+}
+
+func TestMaxAnalysisItems(t *testing.T) {
+	table := Cache("testMaxAnalysisItems")
+	for i := 0; i < 1000; i++ {
+		table.Add(i, 0, v)
+	}
+	table.SetMaxAnalysisItems(100)
+
+	// only the sampled items are considered
+	ma := table.MostAccessed(1000)
+	if len(ma) != 100 {
+		t.Error("MostAccessed did not respect the analysis cap", len(ma))
+	}
+
+	table.SetMaxAnalysisItems(0)
+	if len(table.MostAccessed(1000)) != 1000 {
+		t.Error("MostAccessed limited without an analysis cap")
+	}
+}
+
+func TestIncrementCoercion(t *testing.T) {
+	table := Cache("testIncrementCoercion")
+	table.Add(k+"_int", 0, 1)
+	table.Add(k+"_int32", 0, int32(2))
+	table.Add(k+"_str", 0, v)
+
+	n, err := table.Increment(k+"_int", 2)
+	if err != nil || n != 3 {
+		t.Error("Error incrementing int data", n, err)
+	}
+	n, err = table.Increment(k+"_int32", 2)
+	if err != nil || n != 4 {
+		t.Error("Error incrementing int32 data", n, err)
+	}
+
+	// the result is stored back as int64
+	p, _ := table.Value(k + "_int32")
+	if _, ok := p.Data().(int64); !ok {
+		t.Error("Incremented data not stored as int64")
+	}
+
+	if _, err := table.Increment(k+"_str", 1); err != ErrNotInteger {
+		t.Error("Expected error incrementing non-numeric data")
+	}
+
+	// unsigned values beyond int64 are rejected instead of wrapping
+	table.Add(k+"_max", 0, uint64(math.MaxInt64))
+	n, err = table.Increment(k+"_max", -1)
+	if err != nil || n != math.MaxInt64-1 {
+		t.Error("Error incrementing the largest representable uint64", n, err)
+	}
+	table.Add(k+"_big", 0, uint64(math.MaxInt64)+1)
+	if _, err := table.Increment(k+"_big", 1); err != ErrIntegerOverflow {
+		t.Error("Expected overflow error for uint64 beyond int64", err)
+	}
+	p, _ = table.Value(k + "_big")
+	if p.Data() != uint64(math.MaxInt64)+1 {
+		t.Error("Overflowing increment changed the cached value", p.Data())
+	}
+
+	// so are sums beyond int64
+	table.Add(k+"_sum", 0, int64(math.MaxInt64))
+	if _, err := table.Increment(k+"_sum", 1); err != ErrIntegerOverflow {
+		t.Error("Expected overflow error incrementing past int64", err)
+	}
+	p, _ = table.Value(k + "_sum")
+	if p.Data() != int64(math.MaxInt64) {
+		t.Error("Overflowing increment changed the cached value", p.Data())
+	}
+}
+
+func TestRLockItems(t *testing.T) {
+	table := Cache("testRLockItems")
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, i)
+	}
+
+	var finish sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		finish.Add(1)
+		go func() {
+			defer finish.Done()
+			items, unlock := table.RLockItems()
+			defer unlock()
+			for i := 0; i < 100; i++ {
+				if items[i] == nil || items[i].Data().(int) != i {
+					t.Error("Error reading items under RLockItems")
+				}
+			}
+		}()
+	}
+	// writers have to wait until all readers have unlocked
+	table.Add(100, 0, 100)
+	finish.Wait()
+
+	if table.Count() != 101 {
+		t.Error("Error adding item after RLockItems")
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	table := Cache("testWriteThrough")
+	sink := make(map[interface{}]interface{})
+	fail := false
+	table.SetWriteThrough(func(key interface{}, data interface{}, lifeSpan time.Duration) error {
+		if fail {
+			return ErrKeyNotFound
+		}
+		sink[key] = data
+		return nil
+	})
+
+	table.Add(k, 0, v)
+	if sink[k] != v {
+		t.Error("Write-through not invoked on Add")
+	}
+
+	// best-effort mode keeps the in-memory write on failure
+	fail = true
+	table.Add(k+"_1", 0, v)
+	if !table.Exists(k + "_1") {
+		t.Error("Best-effort write-through rolled back the in-memory write")
+	}
+
+	// strict mode only applies the write once the sink accepted it
+	table.SetWriteThroughStrict(true)
+	table.Add(k+"_2", 0, v)
+	if table.Exists(k + "_2") {
+		t.Error("Strict write-through added the new item")
+	}
+	table.Add(k, 0, v+"_new")
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != v {
+		t.Error("Strict write-through did not restore the replaced item")
+	}
+	if table.NotFoundAdd(k+"_3", 0, v) || table.Exists(k+"_3") {
+		t.Error("Strict write-through did not roll back NotFoundAdd")
+	}
+}
+
+func TestWriteThroughStrictSideEffects(t *testing.T) {
+	table := Cache("testWriteThroughStrictSideEffects")
+	writes := 0
+	fail := false
+	table.SetWriteThrough(func(key interface{}, data interface{}, lifeSpan time.Duration) error {
+		writes++
+		if fail {
+			return ErrKeyNotFound
+		}
+		return nil
+	})
+	table.SetWriteThroughStrict(true)
+	table.SetCapacity(1)
+	table.Add(1, 0, v)
+
+	// a failed strict write neither evicts, fires callbacks nor logs a mutation
+	added := 0
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		added++
+	})
+	table.SetMutationLogSize(8)
+	fail = true
+	table.Add(2, 0, v)
+	if !table.Exists(1) || table.Exists(2) {
+		t.Error("Failed strict write changed the table")
+	}
+	if added != 0 || len(table.MutationLog(8)) != 0 {
+		t.Error("Failed strict write had side effects", added, table.MutationLog(8))
+	}
+
+	// values filled by the loader are not written back
+	writes = 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	if _, err := table.Value(3); err != nil {
+		t.Error("Error loading item", err)
+	}
+	if writes != 0 {
+		t.Error("Loaded item was written back to the sink", writes)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	table := Cache("testSeed")
+	table.Seed(1000, func(i int) (interface{}, time.Duration, interface{}) {
+		return i, 0, i * 2
+	})
+
+	if table.Count() != 1000 {
+		t.Error("Error seeding table", table.Count())
+	}
+	for _, i := range []int{0, 499, 999} {
+		p, err := table.Value(i)
+		if err != nil || p.Data().(int) != i*2 {
+			t.Error("Error retrieving seeded data", i, err)
+		}
+	}
+}
+
+func TestCreatedBetween(t *testing.T) {
+	table := Cache("testCreatedBetween")
+	table.Add(k+"_1", 0, v)
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	table.Add(k+"_2", 0, v)
+	table.Add(k+"_3", 0, v)
+	end := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	table.Add(k+"_4", 0, v)
+
+	items := table.CreatedBetween(start, end)
+	if len(items) != 2 {
+		t.Error("Error retrieving items created within range", len(items))
+	}
+	for _, item := range items {
+		if item.Key() != k+"_2" && item.Key() != k+"_3" {
+			t.Error("Item created outside of range returned", item.Key())
+		}
+	}
+}
+
+func TestDataLoaderE(t *testing.T) {
+	table := Cache("testDataLoaderE")
+	errBackend := errors.New("backend down")
+	table.SetDataLoaderE(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		switch key.(string) {
+		case "err":
+			return nil, errBackend
+		case "nil":
+			return nil, nil
+		}
+		return NewCacheItem(key, 0, v), nil
+	})
+
+	// loader errors are surfaced instead of the generic error
+	_, err := table.Value("err")
+	if !errors.Is(err, errBackend) {
+		t.Error("Loader error not propagated", err)
+	}
+	if table.Exists("err") {
+		t.Error("Failed load was cached")
+	}
+
+	// the error names the key the same way the logs do
+	table.SetKeyStringer(func(key interface{}) string {
+		return "key:" + key.(string)
+	})
+	if _, err := table.Value("err"); err == nil || !strings.Contains(err.Error(), "key:err") {
+		t.Error("Loader error does not use the key stringer", err)
+	}
+	table.SetKeyStringer(nil)
+
+	// a nil item without error is still "not loadable"
+	if _, err = table.Value("nil"); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected not-loadable error", err)
+	}
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != v {
+		t.Error("Error loading data", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	users := CacheNamespace("testNamespaces", "users")
+	sessions := CacheNamespace("testNamespaces", "users", "sessions")
+	other := CacheNamespace("testNamespacesOther")
+	users.Add(k, 0, v)
+
+	if CacheNamespace("testNamespaces", "users") != users || Cache("testNamespaces.users.sessions") != sessions {
+		t.Error("Namespace path did not map to the same table")
+	}
+
+	// dropping a subtree removes all nested tables but not similarly named ones
+	if n := DeleteNamespace("testNamespaces"); n != 2 {
+		t.Error("Error deleting namespace subtree", n)
+	}
+	if CacheNamespace("testNamespaces", "users").Exists(k) {
+		t.Error("Table under deleted namespace still registered")
+	}
+	if CacheNamespace("testNamespacesOther") != other {
+		t.Error("Table outside of deleted namespace was removed")
+	}
+}
+
+func TestTableLifecycleCallback(t *testing.T) {
+	var m sync.Mutex
+	var events []string
+	SetTableLifecycleCallback(func(event string, name string) {
+		m.Lock()
+		events = append(events, event+" "+name)
+		m.Unlock()
+	})
+	defer SetTableLifecycleCallback(nil)
+
+	Cache("testLifecycle")
+	Cache("testLifecycle")
+	DeleteTable("testLifecycle")
+	DeleteTable("testLifecycle")
+
+	m.Lock()
+	defer m.Unlock()
+	if len(events) != 2 || events[0] != TableCreated+" testLifecycle" || events[1] != TableDeleted+" testLifecycle" {
+		t.Error("Unexpected table lifecycle events", events)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	table := Cache("testFindDuplicates")
+	table.Add(1, 0, []int{1, 2})
+	table.Add(2, 0, []int{1, 2})
+	table.Add(3, 0, []int{1, 2})
+	table.Add(4, 0, v)
+	table.Add(5, 0, v)
+	table.Add(6, 0, v+"_unique")
+
+	dups := table.FindDuplicates(nil)
+	if len(dups) != 2 {
+		t.Error("Error finding duplicate groups", dups)
+	}
+	for _, g := range dups {
+		if len(g) != 2 && len(g) != 3 {
+			t.Error("Unexpected duplicate group", g)
+		}
+	}
+
+	// a custom comparison treats every value as equal
+	dups = table.FindDuplicates(func(a, b interface{}) bool { return true })
+	if len(dups) != 1 || len(dups[0]) != 6 {
+		t.Error("Custom equality not used", dups)
+	}
+
+	// values may change concurrently while duplicates are searched
+	table.Add(k, 0, int64(0))
+	var finish sync.WaitGroup
+	finish.Add(2)
+	go func() {
+		defer finish.Done()
+		for i := 0; i < 100; i++ {
+			table.Increment(k, 1)
+		}
+	}()
+	go func() {
+		defer finish.Done()
+		for i := 0; i < 100; i++ {
+			table.FindDuplicates(nil)
+		}
+	}()
+	finish.Wait()
+}
+
+func TestValidator(t *testing.T) {
+	table := Cache("testValidator")
+	loads := 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		return NewCacheItem(key, 0, v)
+	})
+	// items older than 50ms are considered stale
+	table.SetValidator(func(item *CacheItem) bool {
+		return time.Since(item.CreatedOn()) < 50*time.Millisecond
+	})
+	deleted := 0
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted++
+	})
+
+	table.Add(k, 0, v)
+	table.Value(k)
+	if loads != 0 {
+		t.Error("Valid item was reloaded")
+	}
+
+	// a stale read misses, deletes the item and triggers the loader
+	time.Sleep(60 * time.Millisecond)
+	p, err := table.Value(k)
+	if err != nil || p == nil {
+		t.Error("Error reloading invalidated item", err)
+	}
+	if loads != 1 || deleted != 1 {
+		t.Error("Invalid item not deleted and reloaded", loads, deleted)
+	}
+}
+
+func TestMutationLog(t *testing.T) {
+	table := Cache("testMutationLog")
+	table.SetMutationLogSize(3)
+
+	table.Add(1, 0, v)
+	table.Add(2, 0, v)
+	table.Delete(1)
+	table.Add(3, 0, v)
+
+	// only the last three mutations are retained, oldest first
+	entries := table.MutationLog(10)
+	if len(entries) != 3 {
+		t.Error("Mutation log not bounded", len(entries))
+	}
+	expected := []Mutation{{2, MutationAdd, time.Time{}}, {1, MutationDelete, time.Time{}}, {3, MutationAdd, time.Time{}}}
+	for i, m := range entries {
+		if m.Key != expected[i].Key || m.Op != expected[i].Op {
+			t.Error("Mutation log out of order", i, m)
+		}
+		if i > 0 && m.Time.Before(entries[i-1].Time) {
+			t.Error("Mutation timestamps out of order")
+		}
+	}
+
+	if entries = table.MutationLog(1); len(entries) != 1 || entries[0].Key != 3 {
+		t.Error("Error retrieving the most recent mutation", entries)
+	}
+}
+
+func TestIncrementAndTouch(t *testing.T) {
+	table := Cache("testIncrementAndTouch")
+
+	var finish sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		finish.Add(1)
+		go func() {
+			defer finish.Done()
+			if _, err := table.IncrementAndTouch(k, 1, 100*time.Millisecond); err != nil {
+				t.Error("Error incrementing and touching", err)
+			}
+		}()
+	}
+	finish.Wait()
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(int64) != 50 {
+		t.Error("Error counting concurrent increments", err)
+	}
+
+	// every touch refreshes the expiry
+	time.Sleep(70 * time.Millisecond)
+	table.IncrementAndTouch(k, 1, 100*time.Millisecond)
+	time.Sleep(70 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Touched item expired")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Error expiring item after last touch")
+	}
+
+	// sums beyond int64 are rejected instead of wrapping
+	table.Add(k+"_max", 0, int64(math.MaxInt64))
+	if _, err := table.IncrementAndTouch(k+"_max", 1, time.Second); err != ErrIntegerOverflow {
+		t.Error("Expected overflow error incrementing past int64", err)
+	}
+	p, _ = table.Value(k + "_max")
+	if p.Data() != int64(math.MaxInt64) || p.LifeSpan() != 0 {
+		t.Error("Overflowing increment changed the cached item", p.Data(), p.LifeSpan())
+	}
+}
+
+func TestFlushCallbacks(t *testing.T) {
+	table := Cache("testFlushCallbacks")
+	deleted := make(map[interface{}]int)
+	expired := make(map[interface{}]int)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted[item.Key()]++
+	})
+	for i := 0; i < 5; i++ {
+		item := table.Add(i, 10*time.Second, v)
+		item.SetAboutToExpireCallback(func(key interface{}) {
+			expired[key]++
+		})
+	}
+
+	// the plain Flush stays silent
+	table.Flush()
+	if len(deleted) != 0 || len(expired) != 0 {
+		t.Error("Flush fired delete callbacks")
+	}
+
+	for i := 0; i < 5; i++ {
+		item := table.Add(i, 10*time.Second, v)
+		item.SetAboutToExpireCallback(func(key interface{}) {
+			expired[key]++
+		})
+	}
+	table.FlushCallbacks()
+	if table.Count() != 0 {
+		t.Error("Error flushing table with callbacks")
+	}
+	for i := 0; i < 5; i++ {
+		if deleted[i] != 1 || expired[i] != 1 {
+			t.Error("Callbacks not fired exactly once per item", i, deleted[i], expired[i])
+		}
+	}
+}
+
+func TestLowWaterCallback(t *testing.T) {
+	table := Cache("testLowWaterCallback")
+	var m sync.Mutex
+	var calls []int
+	table.SetLowWaterCallback(2, func(remaining int) {
+		m.Lock()
+		calls = append(calls, remaining)
+		m.Unlock()
+	})
+	for i := 0; i < 5; i++ {
+		table.Add(i, 50*time.Millisecond, v)
+	}
+
+	// draining all items crosses the watermark only once
+	time.Sleep(100 * time.Millisecond)
+	m.Lock()
+	if table.Count() != 0 || len(calls) != 1 || calls[0] != 2 {
+		t.Error("Low water callback not fired exactly once", calls)
+	}
+	m.Unlock()
+
+	// refilling above the watermark re-arms the callback
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+	}
+	for i := 0; i < 5; i++ {
+		table.Delete(i)
+	}
+	m.Lock()
+	if len(calls) != 2 {
+		t.Error("Low water callback not re-armed after refill", calls)
+	}
+	m.Unlock()
+}
+
+func TestFlushExpiring(t *testing.T) {
+	table := Cache("testFlushExpiring")
+	deleted := 0
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted++
+	})
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	table.Add(k+"_3", 10*time.Second, v)
+	table.Add(k+"_4", 20*time.Second, v)
+
+	if n := table.FlushExpiring(); n != 2 || deleted != 2 {
+		t.Error("Error flushing expiring items", n, deleted)
+	}
+	if !table.Exists(k+"_1") || !table.Exists(k+"_2") || table.Count() != 2 {
+		t.Error("Permanent items were flushed")
+	}
+
+	// only permanent items remain, so the timer is idle
+	table.RLock()
+	if table.cleanupInterval != 0 {
+		t.Error("Expiration timer still armed after FlushExpiring")
+	}
+	table.RUnlock()
+}
+
+func TestMaintainedCount(t *testing.T) {
+	table := Cache("testMaintainedCount")
+
+	var finish sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		finish.Add(1)
+		go func(g int) {
+			defer finish.Done()
+			for i := 0; i < 200; i++ {
+				key := (g*200 + i) % 300
+				if i%3 == 0 {
+					table.Delete(key)
+				} else {
+					table.Add(key, 0, v)
+				}
+			}
+		}(g)
+	}
+	finish.Wait()
+
+	table.RLock()
+	actual := len(table.items)
+	table.RUnlock()
+	if table.Count() != actual || table.ApproxCount() != int64(actual) {
+		t.Error("Maintained count does not match item total", table.Count(), table.ApproxCount(), actual)
+	}
+
+	table.Flush()
+	if table.Count() != 0 || table.ApproxCount() != 0 {
+		t.Error("Maintained count not reset by Flush", table.Count(), table.ApproxCount())
+	}
+}
+
+func TestModifiedOn(t *testing.T) {
+	table := Cache("testModifiedOn")
+	p := table.Add(k, 0, 1)
+	modified := p.ModifiedOn()
+
+	// reads don't count as modifications
+	time.Sleep(5 * time.Millisecond)
+	table.Value(k)
+	if !p.ModifiedOn().Equal(modified) {
+		t.Error("Value changed modifiedOn")
+	}
+	if !p.AccessedOn().After(modified) {
+		t.Error("Value did not change accessedOn")
+	}
+
+	// writes do
+	time.Sleep(5 * time.Millisecond)
+	table.Increment(k, 1)
+	if !p.ModifiedOn().After(modified) {
+		t.Error("Increment did not change modifiedOn")
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	table := Cache("testModifiedSince")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	table.Increment(1, 1)
+	table.Increment(3, 1)
+	table.Value(2)
+	table.Add(5, 0, 5)
+
+	items := table.ModifiedSince(since)
+	if len(items) != 3 {
+		t.Error("Error retrieving recently modified items", len(items))
+	}
+	for _, item := range items {
+		if key := item.Key().(int); key != 1 && key != 3 && key != 5 {
+			t.Error("Unmodified item returned", key)
+		}
+	}
+}
+
+func TestRefreshTop(t *testing.T) {
+	table := Cache("testRefreshTop")
+	loads := make(map[interface{}]int)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads[key]++
+		return NewCacheItem(key, 0, v+"_fresh")
+	})
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+	}
+	// make 7, 8 and 9 the hottest keys
+	for i := 7; i < 10; i++ {
+		for j := 0; j < i; j++ {
+			table.Value(i)
+		}
+	}
+
+	table.RefreshTop(3)
+	if len(loads) != 3 || loads[7] != 1 || loads[8] != 1 || loads[9] != 1 {
+		t.Error("Loader not invoked once per hot key", loads)
+	}
+	p, _ := table.Value(9)
+	if p.Data().(string) != v+"_fresh" {
+		t.Error("Hot key not refreshed")
+	}
+	// access statistics are kept across the refresh
+	if p.AccessCount() != 10 {
+		t.Error("Access count lost on refresh", p.AccessCount())
+	}
+}
+
+func TestRejectPermanentLoads(t *testing.T) {
+	table := Cache("testRejectPermanentLoads")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if key.(string) == "permanent" {
+			return NewCacheItem(key, 0, v)
+		}
+		return NewCacheItem(key, time.Second, v)
+	})
+
+	// permanent loads are accepted by default
+	if _, err := table.Value("permanent"); err != nil {
+		t.Error("Permanent load rejected by default", err)
+	}
+	table.Delete("permanent")
+
+	table.SetRejectPermanentLoads(true)
+	if _, err := table.Value("permanent"); err != ErrPermanentLoad {
+		t.Error("Expected error for permanent load", err)
+	}
+	if table.Exists("permanent") {
+		t.Error("Rejected permanent load was cached")
+	}
+	if _, err := table.Value("expiring"); err != nil {
+		t.Error("Expiring load rejected", err)
+	}
+}
+
+func TestAccessThresholdCallback(t *testing.T) {
+	table := Cache("testAccessThresholdCallback")
+	table.Add(k, 0, v)
+	fired := 0
+	err := table.SetAccessThresholdCallback(k, 3, func(item *CacheItem) {
+		fired++
+		// the callback runs outside the item lock
+		if item.AccessCount() != 3 {
+			t.Error("Threshold callback fired at the wrong access count")
+		}
+	})
+	if err != nil {
+		t.Error("Error setting access threshold callback", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		table.Value(k)
+	}
+	if fired != 1 {
+		t.Error("Threshold callback not fired exactly once", fired)
+	}
+
+	if table.SetAccessThresholdCallback(k+"_missing", 1, nil) != ErrKeyNotFound {
+		t.Error("Expected error setting callback on missing key")
+	}
+}
+
+func TestSetAllLifeSpans(t *testing.T) {
+	table := Cache("testSetAllLifeSpans")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Add(5, 20*time.Millisecond, v)
+
+	// making everything permanent keeps the expiring item alive
+	if n := table.SetAllLifeSpans(0); n != 6 {
+		t.Error("Error counting updated items", n)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if table.Count() != 6 {
+		t.Error("Permanent item expired")
+	}
+
+	// the new lifespan takes effect on the next sweep
+	table.SetAllLifeSpans(30 * time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Items did not expire with their new lifespan", table.Count())
+	}
+}
+
+func TestCopyItem(t *testing.T) {
+	table := Cache("testCopyItem")
+	table.SetDataCopier(func(data interface{}) interface{} {
+		return append([]int(nil), data.([]int)...)
+	})
+	p := table.Add(k, time.Second, []int{1, 2, 3})
+	p.SetAboutToExpireCallback(func(key interface{}) {})
+
+	c, ok := table.CopyItem(k)
+	if !ok || c.Key() != k || c.LifeSpan() != time.Second || c.aboutToExpire != nil {
+		t.Error("Error copying item")
+	}
+
+	// later table mutations don't reach the copy
+	p.Data().([]int)[0] = 100
+	table.Value(k)
+	table.Delete(k)
+	if c.Data().([]int)[0] != 1 || c.AccessCount() != 0 {
+		t.Error("Copy not independent of the cached item")
+	}
+
+	if _, ok := table.CopyItem(k); ok {
+		t.Error("Copied a missing key")
+	}
+}
+
+func TestItemFinalizer(t *testing.T) {
+	table := Cache("testItemFinalizer")
+	finalized := make(chan interface{}, 1)
+	table.SetItemFinalizer(func(key interface{}) {
+		finalized <- key
+	})
+	table.Add(k, 0, v)
+	table.Delete(k)
+
+	// the dropped item gets collected eventually
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case key := <-finalized:
+			if key != k {
+				t.Error("Finalizer fired for the wrong key", key)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Error("Finalizer did not fire after the item was dropped")
+}
+
+func TestUpdateFunc(t *testing.T) {
+	table := Cache("testUpdateFunc")
+	appendOne := func(old interface{}) interface{} {
+		s, _ := old.([]int)
+		return append(s, 1)
+	}
+
+	if _, err := table.UpdateFunc(k, time.Second, appendOne); err != ErrKeyNotFound {
+		t.Error("Expected error updating missing key", err)
+	}
+	table.SetUpdateFuncCreates(true)
+
+	var finish sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		finish.Add(1)
+		go func() {
+			defer finish.Done()
+			if _, err := table.UpdateFunc(k, time.Second, appendOne); err != nil {
+				t.Error("Error updating item", err)
+			}
+		}()
+	}
+	finish.Wait()
+
+	// no update got lost
+	p, _ := table.Value(k)
+	if len(p.Data().([]int)) != 100 {
+		t.Error("Lost updates in UpdateFunc", len(p.Data().([]int)))
+	}
+	if p.LifeSpan() != time.Second {
+		t.Error("UpdateFunc did not set the lifespan")
+	}
+}
+
+func TestKeyStringer(t *testing.T) {
+	type compositeKey struct {
+		tenant string
+		id     int
+	}
+	out := new(bytes.Buffer)
+	table := Cache("testKeyStringer")
+	table.SetLogger(log.New(out, "", 0))
+	table.SetKeyStringer(func(key interface{}) string {
+		ck := key.(compositeKey)
+		return ck.tenant + "/" + strconv.Itoa(ck.id)
+	})
+
+	table.Add(compositeKey{"acme", 42}, 0, v)
+	if !strings.Contains(out.String(), "Adding item with key acme/42 ") {
+		t.Error("Custom key stringer not used in log output", out.String())
+	}
+}
+
+func TestAgeAndIdleTime(t *testing.T) {
+	table := Cache("testAgeAndIdleTime")
+	p := table.Add(k, 0, v)
+
+	time.Sleep(40 * time.Millisecond)
+	table.Value(k)
+	time.Sleep(20 * time.Millisecond)
+
+	if age := p.Age(); age < 60*time.Millisecond || age > time.Since(p.CreatedOn()) {
+		t.Error("Error getting item age", age)
+	}
+	if idle := p.IdleTime(); idle < 20*time.Millisecond || idle >= 60*time.Millisecond {
+		t.Error("Error getting item idle time", idle)
+	}
+}
+
+func TestTablesSummary(t *testing.T) {
+	Cache("testTablesSummaryA").Add(k, 0, v)
+	b := Cache("testTablesSummaryB")
+	b.Add(k+"_1", 0, v)
+	b.Add(k+"_2", 0, v)
+
+	// concurrent table churn must not break the summary
+	var finish sync.WaitGroup
+	finish.Add(1)
+	go func() {
+		defer finish.Done()
+		for i := 0; i < 100; i++ {
+			Cache("testTablesSummaryChurn")
+			DeleteTable("testTablesSummaryChurn")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		TablesSummary()
+	}
+	finish.Wait()
+
+	summary := TablesSummary()
+	if summary["testTablesSummaryA"] != 1 || summary["testTablesSummaryB"] != 2 {
+		t.Error("Error summarizing tables", summary)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	table := Cache("testSoftDelete")
+	table.SetSoftDeleteWindow(50 * time.Millisecond)
+	var deleted int32
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&deleted, 1)
+	})
+	table.Add(k, 0, v)
+
+	// soft-deleted items are hidden
+	if err := table.SoftDelete(k); err != nil {
+		t.Error("Error soft-deleting item", err)
+	}
+	if table.Exists(k) || table.Count() != 0 {
+		t.Error("Soft-deleted item still visible")
+	}
+	if _, err := table.Value(k); err != ErrKeyNotFound {
+		t.Error("Soft-deleted item returned by Value", err)
+	}
+
+	// and can be restored within the window
+	if err := table.Undelete(k); err != nil {
+		t.Error("Error undeleting item", err)
+	}
+	if p, err := table.Value(k); err != nil || p.Data().(string) != v || table.Count() != 1 {
+		t.Error("Undeleted item not restored", err)
+	}
+
+	// after the window the item is gone for good
+	table.SoftDelete(k)
+	time.Sleep(80 * time.Millisecond)
+	if atomic.LoadInt32(&deleted) != 1 {
+		t.Error("Delete callback not fired after soft-delete window", deleted)
+	}
+	if table.Undelete(k) != ErrKeyNotFound {
+		t.Error("Undeleted item after soft-delete window")
+	}
+}
+
+func TestMinCleanupInterval(t *testing.T) {
+	table := Cache("testMinCleanupInterval")
+	table.SetMinCleanupInterval(20 * time.Millisecond)
+	for i := 1; i <= 20; i++ {
+		table.Add(i, time.Duration(i)*100*time.Microsecond, v)
+	}
+
+	out := new(bytes.Buffer)
+	table.SetLogger(log.New(out, "", 0))
+	time.Sleep(70 * time.Millisecond)
+
+	// the near-simultaneous expiries are coalesced into few sweeps
+	table.Lock()
+	sweeps := strings.Count(out.String(), "Expiration check triggered")
+	table.Unlock()
+	if sweeps == 0 || sweeps > 4 {
+		t.Error("Unexpected number of sweeps", sweeps)
+	}
+	if table.Count() != 0 {
+		t.Error("Items did not expire", table.Count())
+	}
+}
+
+func TestAllTyped(t *testing.T) {
+	table := Cache("testAllTyped")
+	table.Add(1, 0, 10)
+	table.Add(2, 0, 20)
+	table.Add(3, 0, v)
+	table.Add(4, 0, int64(40))
+
+	ints, mismatched := AllTyped[int](table)
+	if len(ints) != 2 || ints[0]+ints[1] != 30 {
+		t.Error("Error collecting typed data", ints)
+	}
+	if len(mismatched) != 2 {
+		t.Error("Error reporting mismatched keys", mismatched)
+	}
+	for _, key := range mismatched {
+		if key != 3 && key != 4 {
+			t.Error("Unexpected mismatched key", key)
+		}
+	}
+
+	// values may change concurrently while they are collected
+	var finish sync.WaitGroup
+	finish.Add(2)
+	go func() {
+		defer finish.Done()
+		for i := 0; i < 100; i++ {
+			table.Increment(4, 1)
+		}
+	}()
+	go func() {
+		defer finish.Done()
+		for i := 0; i < 100; i++ {
+			AllTyped[int64](table)
+		}
+	}()
+	finish.Wait()
+}
+
+func TestReadInterceptor(t *testing.T) {
+	table := Cache("testReadInterceptor")
+	table.Add(k, 0, v)
+	hits, misses := 0, 0
+	it := table.WithReadInterceptor(func(key interface{}, hit bool) {
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+	})
+
+	it.Value(k)
+	it.Value(k + "_missing")
+	it.Exists(k)
+	it.Exists(k + "_missing")
+	it.Value2(k)
+	it.Value2(k + "_missing")
+	it.ExistsMany([]interface{}{k, k + "_missing", k + "_other"})
+	if hits != 4 || misses != 5 {
+		t.Error("Interceptor did not observe hits and misses", hits, misses)
+	}
+
+	// the base table is unaffected
+	table.Value(k)
+	table.Value2(k)
+	table.ExistsMany([]interface{}{k})
+	if hits != 4 {
+		t.Error("Base table reads were intercepted")
+	}
+}
+
+func TestRecomputeExpiration(t *testing.T) {
+	table := Cache("testRecomputeExpiration")
+	items := []*CacheItem{table.Add(1, 0, v), table.Add(2, 0, v), table.Add(3, 0, v)}
+
+	// direct mutations go unnoticed by the table
+	items[0].SetLifeSpan(20 * time.Millisecond)
+	items[1].SetLifeSpan(20 * time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if table.Count() != 3 {
+		t.Error("Items reaped without a scheduled sweep")
+	}
+
+	table.RecomputeExpiration()
+	if table.Count() != 1 || !table.Exists(3) {
+		t.Error("Error reaping items after RecomputeExpiration", table.Count())
+	}
+
+	// a fresh item gets a timer armed for its new lifespan
+	table.Value(3)
+	items[2].SetLifeSpan(20 * time.Millisecond)
+	table.RecomputeExpiration()
+	if !table.Exists(3) {
+		t.Error("Fresh item reaped early")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Recomputed schedule did not reap the remaining item")
+	}
+}
+
+func TestTypedData(t *testing.T) {
+	table := Cache("testTypedData")
+	s := table.Add(k+"_string", 0, v)
+	n := table.Add(k+"_int64", 0, int64(42))
+	b := table.Add(k+"_bytes", 0, []byte("abc"))
+
+	if d, ok := s.DataString(); !ok || d != v {
+		t.Error("Error retrieving string data")
+	}
+	if d, ok := n.DataInt64(); !ok || d != 42 {
+		t.Error("Error retrieving int64 data")
+	}
+	d, ok := b.DataBytes()
+	if !ok || string(d) != "abc" {
+		t.Error("Error retrieving bytes data")
+	}
+
+	// the returned bytes are a defensive copy
+	d[0] = 'x'
+	if string(b.Data().([]byte)) != "abc" {
+		t.Error("Mutating returned bytes changed the cached data")
+	}
+
+	// mismatched types report ok=false instead of panicking
+	if _, ok := s.DataInt64(); ok {
+		t.Error("DataInt64 matched string data")
+	}
+	if _, ok := n.DataBytes(); ok {
+		t.Error("DataBytes matched int64 data")
+	}
+	if _, ok := b.DataString(); ok {
+		t.Error("DataString matched bytes data")
+	}
+}
+
+func TestRecentHitRatio(t *testing.T) {
+	table := Cache("testRecentHitRatio")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+
+	// a cold phase where every read needs the loader
+	for i := 0; i < 10; i++ {
+		table.Value(i)
+	}
+	if r := table.RecentHitRatio(time.Second); r != 0 {
+		t.Error("Unexpected hit ratio for cold reads", r)
+	}
+
+	// followed by a hot phase served from cache
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		table.Value(i)
+	}
+	if r := table.RecentHitRatio(20 * time.Millisecond); r != 1 {
+		t.Error("Recent hit ratio does not track the hot phase", r)
+	}
+	if r := table.RecentHitRatio(time.Second); r != 0.5 {
+		t.Error("Unexpected hit ratio over both phases", r)
+	}
+}
+
+func TestForeachLimit(t *testing.T) {
+	table := Cache("testForeachLimit")
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+
+	visited := 0
+	table.ForeachLimit(10, func(key interface{}, item *CacheItem) {
+		visited++
+	})
+	if visited != 10 {
+		t.Error("ForeachLimit visited wrong number of items", visited)
+	}
+
+	visited = 0
+	table.ForeachLimit(1000, func(key interface{}, item *CacheItem) {
+		visited++
+	})
+	if visited != 100 {
+		t.Error("ForeachLimit did not visit all items below the limit", visited)
+	}
+}
+
+func TestItemInitializer(t *testing.T) {
+	table := Cache("testItemInitializer")
+	var m sync.Mutex
+	expired := make(map[interface{}]bool)
+	table.SetItemInitializer(func(item *CacheItem) {
+		item.SetAboutToExpireCallback(func(key interface{}) {
+			m.Lock()
+			expired[key] = true
+			m.Unlock()
+		})
+	})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+
+	table.Add(1, 0, v)
+	table.NotFoundAdd(2, 0, v)
+	table.AddBatch([]*CacheItem{NewCacheItem(3, 0, v)})
+	table.Value(4)
+
+	// every added item got the default callback
+	table.FlushCallbacks()
+	m.Lock()
+	defer m.Unlock()
+	if len(expired) != 4 {
+		t.Error("Initializer not applied to every added item", expired)
+	}
+}
+
+func TestValue2(t *testing.T) {
+	table := Cache("testValue2")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if key.(string) == "loadable" {
+			return NewCacheItem(key, 0, v)
+		}
+		return nil
+	})
+	table.Add(k, 0, v)
+
+	for _, key := range []string{k, "loadable", "missing"} {
+		p, err := table.Value(key)
+		p2, ok := table.Value2(key)
+		if (err == nil) != ok {
+			t.Error("Value2 found flag disagrees with Value", key)
+		}
+		if ok && p2.Data() != p.Data() {
+			t.Error("Value2 returned different data than Value", key)
+		}
+		if !ok && p2 != nil {
+			t.Error("Value2 returned an item on a miss", key)
+		}
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	table := Cache("testValueTypes")
+	table.Add(1, 0, v)
+	table.Add(2, 0, v)
+	table.Add(3, 0, 3)
+	table.Add(4, 0, []byte{})
+	table.Add(5, 0, &CacheItem{})
+	table.Add(6, 0, nil)
+
+	types := table.ValueTypes()
+	if len(types) != 5 || types["<nil>"] != 1 || types["string"] != 2 || types["int"] != 1 || types["[]uint8"] != 1 || types["*cache2go.CacheItem"] != 1 {
+		t.Error("Error computing value type histogram", types)
+	}
+}
+
+func TestWriteCount(t *testing.T) {
+	table := Cache("testWriteCount")
+	p := table.Add(k, 0, 0)
+
+	table.Increment(k, 1)
+	table.IncrementBounded(k, 1, 10)
+	table.IncrementAndTouch(k, 1, 0)
+	table.UpdateFunc(k, 0, func(old interface{}) interface{} { return old })
+	table.Value(k)
+	table.Value(k)
+
+	// reads are tracked separately from writes
+	if p.WriteCount() != 4 {
+		t.Error("Error counting writes", p.WriteCount())
+	}
+	if p.AccessCount() != 2 {
+		t.Error("Writes counted as reads", p.AccessCount())
+	}
+}
+
+func TestValueInterner(t *testing.T) {
+	table := Cache("testValueInterner")
+	pool := make(map[string]*string)
+	table.SetValueInterner(func(data interface{}) interface{} {
+		s := data.(*string)
+		if canonical, ok := pool[*s]; ok {
+			return canonical
+		}
+		pool[*s] = s
+		return s
+	})
+
+	a, b, c := v, v, v+"_other"
+	table.Add(1, 0, &a)
+	table.Add(2, 0, &b)
+	table.Add(3, 0, &c)
+
+	p1, _ := table.Value(1)
+	p2, _ := table.Value(2)
+	p3, _ := table.Value(3)
+	// equal values share one instance, distinct ones don't
+	if p1.Data().(*string) != p2.Data().(*string) {
+		t.Error("Equal values not interned to the same instance")
+	}
+	if p1.Data().(*string) == p3.Data().(*string) || *p3.Data().(*string) != c {
+		t.Error("Distinct values collapsed by interner")
+	}
+}
+
+func TestRegisterLoader(t *testing.T) {
+	RegisterLoader("testRegisterLoader", func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+
+	// the table is created after the loader was registered
+	table := Cache("testRegisterLoader")
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != v {
+		t.Error("Registered loader not wired on table creation", err)
+	}
+}
+
+func TestAccessHistory(t *testing.T) {
+	table := Cache("testAccessHistory")
+	table.Add(1, 0, v)
+	table.SetAccessHistorySize(3)
+	p := table.Add(2, 0, v)
+
+	var accesses []time.Time
+	for i := 0; i < 5; i++ {
+		table.Value(1)
+		table.Value(2)
+		accesses = append(accesses, p.AccessedOn())
+		time.Sleep(time.Millisecond)
+	}
+
+	// only the most recent accesses are kept, oldest first
+	history := p.AccessHistory()
+	if len(history) != 3 {
+		t.Error("Access history not bounded", len(history))
+	}
+	for i, at := range history {
+		if !at.Equal(accesses[2+i]) {
+			t.Error("Access history does not match the most recent accesses", i)
+		}
+	}
+
+	// items added before enabling history don't track it
+	p1, _ := table.Value(1)
+	if len(p1.AccessHistory()) != 0 {
+		t.Error("Access history recorded without being enabled")
+	}
+}
+
+func TestTouchIfBelow(t *testing.T) {
+	table := Cache("testTouchIfBelow")
+	table.Add(k, 100*time.Millisecond, v)
+
+	// plenty of life left, nothing to refresh
+	if touched, err := table.TouchIfBelow(k, 50*time.Millisecond, 100*time.Millisecond); err != nil || touched {
+		t.Error("Item refreshed above the threshold", err)
+	}
+
+	// below the threshold only the first call refreshes
+	time.Sleep(60 * time.Millisecond)
+	touched := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := table.TouchIfBelow(k, 50*time.Millisecond, 100*time.Millisecond); ok {
+			touched++
+		}
+	}
+	if touched != 1 {
+		t.Error("Item not refreshed exactly once below the threshold", touched)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Refreshed item expired")
+	}
+
+	if _, err := table.TouchIfBelow(k+"_missing", 0, 0); err != ErrKeyNotFound {
+		t.Error("Expected error touching missing key")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	table := Cache("testConfig")
+	table.SetMinCleanupInterval(time.Second)
+	table.SetMutationLogSize(16)
+	table.SetDefaultLoaderArgs("pool")
+	table.SetWriteThroughStrict(true)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return nil
+	})
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {})
+
+	c := table.Config()
+	if c.Name != "testConfig" || c.MinCleanupInterval != time.Second || c.MutationLogSize != 16 {
+		t.Error("Config does not reflect table settings", c)
+	}
+	if len(c.DefaultLoaderArgs) != 1 || !c.WriteThroughStrict {
+		t.Error("Config does not reflect loader and write-through settings", c)
+	}
+	if !c.HasDataLoader || !c.HasAboutToDeleteItem || c.HasAddedItem || c.HasLogger {
+		t.Error("Config does not reflect configured callbacks", c)
+	}
+}
+
+func TestSweepGuard(t *testing.T) {
+	table := Cache("testSweepGuard")
+	var allow int32
+	table.SetSweepGuard(func() bool {
+		return atomic.LoadInt32(&allow) == 1
+	})
+	table.SetMinCleanupInterval(10 * time.Millisecond)
+	table.Add(k, 20*time.Millisecond, v)
+
+	// expired items survive while the guard vetoes sweeps
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item purged despite the sweep guard")
+	}
+
+	// the skipped sweep is rescheduled and runs once allowed
+	atomic.StoreInt32(&allow, 1)
+	time.Sleep(50 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Rescheduled sweep did not purge the expired item")
+	}
+}
+
+func TestSnapshotTables(t *testing.T) {
+	orders := Cache("testSnapshotOrders")
+	customers := Cache("testSnapshotCustomers")
+	customers.Add("alice", 0, v)
+	orders.Add(1, 0, "alice")
+	orders.Add(2, 0, "alice")
+
+	snapshot := SnapshotTables("testSnapshotOrders", "testSnapshotCustomers", "testSnapshotMissing")
+	if len(snapshot) != 2 {
+		t.Error("Unexpected tables in snapshot", len(snapshot))
+	}
+	if len(snapshot["testSnapshotOrders"]) != 2 || len(snapshot["testSnapshotCustomers"]) != 1 {
+		t.Error("Error snapshotting tables")
+	}
+
+	// the snapshot doesn't follow later mutations
+	orders.Delete(1)
+	if _, ok := snapshot["testSnapshotOrders"][1]; !ok {
+		t.Error("Snapshot changed after table mutation")
+	}
+}
+
+func TestItemsInInsertionOrder(t *testing.T) {
+	table := Cache("testItemsInInsertionOrder")
+	keys := []string{"c", "a", "d", "b"}
+	for _, key := range keys[:2] {
+		table.Add(key, 0, v)
+	}
+	table.AddBatch([]*CacheItem{NewCacheItem(keys[2], 0, v), NewCacheItem(keys[3], 0, v)})
+
+	items := table.ItemsInInsertionOrder()
+	if len(items) != len(keys) {
+		t.Error("Error retrieving items in insertion order", len(items))
+	}
+	for i, item := range items {
+		if item.Key() != keys[i] {
+			t.Error("Items not returned in insertion order", i, item.Key())
+		}
+	}
+}
+
+func TestKeepAliveCallback(t *testing.T) {
+	table := Cache("testKeepAliveCallback")
+	item := table.Add(k, 0, v)
+	created := item.AccessedOn()
+
+	var previous, current time.Time
+	item.SetKeepAliveCallback(func(item *CacheItem, previousAccessedOn time.Time) {
+		previous = previousAccessedOn
+		current = item.AccessedOn()
+	})
+	time.Sleep(5 * time.Millisecond)
+	table.Value(k)
+	if !previous.Equal(created) {
+		t.Error("KeepAlive callback got wrong previous access time", previous, created)
+	}
+	if !current.After(previous) {
+		t.Error("Access time was not extended by KeepAlive", current, previous)
+	}
+
+	item.SetKeepAliveCallback(nil)
+	table.Value(k)
+}
+
+func TestExistsMany(t *testing.T) {
+	table := Cache("testExistsMany")
+	table.Add("a", 0, v)
+	table.Add("c", 0, v)
+
+	r := table.ExistsMany([]interface{}{"a", "b", "c", "d"})
+	if len(r) != 4 {
+		t.Error("ExistsMany returned wrong number of keys", len(r))
+	}
+	if !r["a"] || r["b"] || !r["c"] || r["d"] {
+		t.Error("ExistsMany returned wrong result", r)
+	}
+}
+
+func TestAddRW(t *testing.T) {
+	table := Cache("testAddRW")
+	table.AddRW(k, 300*time.Millisecond, 50*time.Millisecond, 1)
+
+	// a read extends the item to its read span
+	p, err := table.Value(k)
+	if err != nil || p.LifeSpan() != 300*time.Millisecond {
+		t.Error("Read did not extend item to read span", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item expired before read span")
+	}
+
+	// a write resets it to the write span
+	if _, err := table.Increment(k, 1); err != nil {
+		t.Error("Error incrementing item", err)
+	}
+	if p.LifeSpan() != 50*time.Millisecond {
+		t.Error("Write did not reset item to write span", p.LifeSpan())
+	}
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item did not expire after write span")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	table := Cache("testCollect")
+	table.Add(1, 0, "a")
+	table.Add(2, 0, "bb")
+	table.Add(3, 0, 30)
+
+	lengths := Collect(table, func(item *CacheItem) (int, bool) {
+		s, ok := item.DataString()
+		return len(s), ok
+	})
+	if len(lengths) != 2 || lengths[0]+lengths[1] != 3 {
+		t.Error("Error collecting projected data", lengths)
+	}
+}
+
+func TestLoaderKeyFilter(t *testing.T) {
+	table := Cache("testLoaderKeyFilter")
+	loads := 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		return NewCacheItem(key, 0, v)
+	})
+	table.SetLoaderKeyFilter(func(key interface{}) bool {
+		s, ok := key.(string)
+		return ok && strings.HasPrefix(s, "user:")
+	})
+
+	if _, err := table.Value("user:1"); err != nil {
+		t.Error("Error loading matching key", err)
+	}
+	if _, err := table.Value("order:1"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for filtered key", err)
+	}
+	if _, err := table.Value(1); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for filtered key", err)
+	}
+	if loads != 1 {
+		t.Error("Loader called for filtered keys", loads)
+	}
+	if !table.Config().HasLoaderKeyFilter {
+		t.Error("Config does not report loader key filter")
+	}
+}
+
+func TestAddBatchWithPolicy(t *testing.T) {
+	batch := func() []*CacheItem {
+		return []*CacheItem{
+			NewCacheItem("a", 0, 1),
+			NewCacheItem("b", 0, 2),
+			NewCacheItem("a", 0, 3),
+		}
+	}
+	for _, tc := range []struct {
+		policy DuplicatePolicy
+		err    error
+		count  int
+		a      interface{}
+	}{
+		{DuplicateLastWins, nil, 2, 3},
+		{DuplicateFirstWins, nil, 2, 1},
+		{DuplicateError, ErrDuplicateKey, 0, nil},
+	} {
+		table := Cache("testAddBatchWithPolicy" + strconv.Itoa(int(tc.policy)))
+		added := 0
+		table.SetAddedItemCallback(func(item *CacheItem) {
+			added++
+		})
+		if err := table.AddBatchWithPolicy(batch(), tc.policy); err != tc.err {
+			t.Error("Unexpected error for policy", tc.policy, err)
+		}
+		if table.Count() != tc.count || added != tc.count {
+			t.Error("Wrong number of items added for policy", tc.policy, table.Count(), added)
+		}
+		if tc.a != nil {
+			p, err := table.Value("a")
+			if err != nil || p.Data() != tc.a {
+				t.Error("Wrong duplicate kept for policy", tc.policy, err)
+			}
+		}
+	}
+}
+
+func TestReduce(t *testing.T) {
+	table := Cache("testReduce")
+	for i := 1; i <= 10; i++ {
+		table.Add(i, 0, i)
+	}
+	table.Add("skip", 0, v)
+
+	total := table.Reduce(0, func(acc interface{}, key interface{}, item *CacheItem) interface{} {
+		if n, ok := item.Data().(int); ok {
+			return acc.(int) + n
+		}
+		return acc
+	})
+	if total != 55 {
+		t.Error("Error reducing cached values", total)
+	}
+}
+
+func TestSampleKeys(t *testing.T) {
+	a := Cache("testSampleKeysA")
+	b := Cache("testSampleKeysB")
+	for i := 0; i < 1000; i++ {
+		a.Add(i, 0, v)
+		b.Add(i, 0, v)
+	}
+	a.SetRandSource(rand.NewSource(42))
+	b.SetRandSource(rand.NewSource(42))
+
+	sa := a.SampleKeys(0.1)
+	sb := b.SampleKeys(0.1)
+	if len(sa) != 100 {
+		t.Error("Sample size does not match fraction", len(sa))
+	}
+	if len(sa) != len(sb) {
+		t.Error("Samples with identical seeds differ in size", len(sa), len(sb))
+	}
+	seen := make(map[interface{}]bool)
+	for i := range sa {
+		if sa[i] != sb[i] {
+			t.Error("Samples with identical seeds differ", i, sa[i], sb[i])
+			break
+		}
+		if seen[sa[i]] {
+			t.Error("Sample contains duplicate key", sa[i])
+		}
+		seen[sa[i]] = true
+	}
+	if len(a.SampleKeys(0)) != 0 || len(a.SampleKeys(2)) != 1000 {
+		t.Error("Error clamping sample fraction")
+	}
+}
+
+func TestExpirationPolicy(t *testing.T) {
+	table := Cache("testExpirationPolicy")
+	table.Add(k, 100*time.Millisecond, v)
+
+	// sliding expiration keeps the item alive past its lifespan
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Fatal("Kept-alive item expired under sliding expiration", err)
+		}
+	}
+
+	// absolute expiration counts from creation, so the item is already due
+	table.SetExpirationPolicy(ExpireAbsolute)
+	if table.Exists(k) {
+		t.Error("Item did not expire after switching to absolute expiration")
+	}
+	if table.Config().ExpirationPolicy != ExpireAbsolute {
+		t.Error("Config does not report expiration policy")
+	}
+}
+
+func TestCallbackDurations(t *testing.T) {
+	table := Cache("testCallbackDurations")
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {})
+	table.Add(1, 0, v)
+	table.Add(2, 0, v)
+	table.Delete(1)
+
+	durations := table.CallbackDurations()
+	added := durations[CallbackAddedItem]
+	if added.Calls != 2 || added.Max < 20*time.Millisecond || added.Total < 40*time.Millisecond {
+		t.Error("Error recording added item callback duration", added)
+	}
+	if durations[CallbackAboutToDeleteItem].Calls != 1 {
+		t.Error("Error recording delete callback calls", durations[CallbackAboutToDeleteItem])
+	}
+	if _, ok := durations[CallbackBulkAddedItem]; ok {
+		t.Error("Recorded duration for a callback that never ran")
+	}
+}
+
+func TestCacheFrom(t *testing.T) {
+	tmpl := TableTemplate{
+		Logger:             log.New(&bytes.Buffer{}, "", 0),
+		MinCleanupInterval: 10 * time.Millisecond,
+		SoftDeleteWindow:   time.Minute,
+		MutationLogSize:    16,
+		AddedItem:          func(item *CacheItem) {},
+	}
+	a := CacheFrom("testCacheFromA", tmpl)
+	b := CacheFrom("testCacheFromB", tmpl)
+	for _, table := range []*CacheTable{a, b} {
+		c := table.Config()
+		if c.MinCleanupInterval != tmpl.MinCleanupInterval || c.SoftDeleteWindow != tmpl.SoftDeleteWindow ||
+			c.MutationLogSize != tmpl.MutationLogSize || !c.HasLogger || !c.HasAddedItem {
+			t.Error("Table not configured from template", c)
+		}
+	}
+
+	// existing tables are left alone unless asked
+	existing := Cache("testCacheFromExisting")
+	CacheFrom("testCacheFromExisting", tmpl)
+	if existing.Config().HasLogger {
+		t.Error("Template applied to existing table")
+	}
+	tmpl.ApplyToExisting = true
+	CacheFrom("testCacheFromExisting", tmpl)
+	if !existing.Config().HasLogger {
+		t.Error("Template not applied to existing table")
+	}
+}
+
+func TestTotalAccessCount(t *testing.T) {
+	table := Cache("testTotalAccessCount")
+	for i := 0; i < 3; i++ {
+		table.Add(i, 0, v)
+		for j := 0; j <= i; j++ {
+			table.Value(i)
+		}
+	}
+	if n := table.TotalAccessCount(); n != 6 {
+		t.Error("Error summing access counts", n)
+	}
+
+	// the sum saturates instead of overflowing
+	p, _ := table.Value(0)
+	p.Lock()
+	p.accessCount = math.MaxInt64 - 1
+	p.Unlock()
+	if n := table.TotalAccessCount(); n != math.MaxInt64 {
+		t.Error("Total access count overflowed", n)
+	}
+}
+
+func TestMostRecentlyAccessed(t *testing.T) {
+	table := Cache("testMostRecentlyAccessed")
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+	}
+	time.Sleep(time.Millisecond)
+	table.Value(7)
+	time.Sleep(time.Millisecond)
+	table.Value(3)
+
+	ra := table.MostRecentlyAccessed(2)
+	if len(ra) != 2 || ra[0].Key() != 3 || ra[1].Key() != 7 {
+		t.Error("Error retrieving most recently accessed items", ra)
+	}
+	if len(table.MostRecentlyAccessed(100)) != 10 {
+		t.Error("Error retrieving all recently accessed items")
+	}
+	if table.MostRecentlyAccessed(0) != nil || table.MostRecentlyAccessed(-1) != nil {
+		t.Error("Expected no items for a non-positive count")
+	}
+}
+
+func TestExpirationCheckPanic(t *testing.T) {
+	table := Cache("testExpirationCheckPanic")
+	table.SetMinCleanupInterval(10 * time.Millisecond)
+	var panics, deleted int32
+	table.SetPanicHandler(func(recovered interface{}) {
+		atomic.AddInt32(&panics, 1)
+	})
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		// the first sweep dies here
+		if atomic.AddInt32(&deleted, 1) == 1 {
+			panic("callback failed")
+		}
+	})
+	table.Add(1, 20*time.Millisecond, v)
+	table.Add(2, 40*time.Millisecond, v)
+
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&panics) != 1 {
+		t.Error("Panic handler not called once", atomic.LoadInt32(&panics))
+	}
+	if table.Count() != 0 {
+		t.Error("Expiration stopped after a panicking sweep", table.Count())
+	}
+}
+
+func TestLoaderTimeout(t *testing.T) {
+	table := Cache("testLoaderTimeout")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if key == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return NewCacheItem(key, 0, v)
+	})
+	table.SetLoaderTimeout(20 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := table.Value("slow"); err != ErrLoaderTimeout {
+		t.Error("Expected ErrLoaderTimeout", err)
+	}
+	if time.Since(start) >= 100*time.Millisecond {
+		t.Error("Value waited for the slow loader")
+	}
+	if _, err := table.Value("fast"); err != nil {
+		t.Error("Error loading within timeout", err)
+	}
+
+	// the late result is discarded
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists("slow") {
+		t.Error("Late loader result was added to the cache")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	table := Cache("testCapacity")
+	table.SetCapacity(3)
+	var evicted []interface{}
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		evicted = append(evicted, item.Key())
+	})
+	for i := 0; i < 3; i++ {
+		table.Add(i, 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	// 0 is now the most recently used, 1 the least
+	table.Value(0)
+
+	table.Add(3, 0, v)
+	if table.Count() != 3 || table.Exists(1) {
+		t.Error("Least recently used item was not evicted", table.Count())
+	}
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Error("Eviction did not run delete callbacks", evicted)
+	}
+
+	// 0 means unbounded
+	table.SetCapacity(0)
+	table.Add(4, 0, v)
+	if table.Count() != 4 {
+		t.Error("Capacity 0 should not evict", table.Count())
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	table := Cache("testWriteMetrics")
+	table.SetCapacity(1)
+	table.Add(1, 0, v)
+	table.Add(2, 0, v)
+	table.Value(2)
+	table.Value(3)
+
+	var buf bytes.Buffer
+	if err := table.WriteMetrics(&buf, "app_cache"); err != nil {
+		t.Fatal("Error writing metrics", err)
+	}
+	for _, line := range []string{
+		"# TYPE app_cache_hits_total counter",
+		`app_cache_hits_total{table="testWriteMetrics"} 1`,
+		`app_cache_misses_total{table="testWriteMetrics"} 1`,
+		`app_cache_evictions_total{table="testWriteMetrics"} 1`,
+		"# TYPE app_cache_items gauge",
+		`app_cache_items{table="testWriteMetrics"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Error("Metrics output is missing line", line)
+		}
+	}
+	if strings.Contains(buf.String(), "app_cache_bytes") {
+		t.Error("Byte size written without a size func")
+	}
+
+	// the byte size is reported once a size func is configured
+	table.SetCapacity(0)
+	table.Add(4, 0, "abcd")
+	table.SetSizeFunc(func(data interface{}) int64 {
+		s, _ := data.(string)
+		return int64(len(s))
+	})
+	buf.Reset()
+	table.WriteMetrics(&buf, "app_cache")
+	want := "# TYPE app_cache_bytes gauge\n" + `app_cache_bytes{table="testWriteMetrics"} ` + strconv.Itoa(4+len(v)) + "\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Error("Metrics output is missing the byte size", buf.String())
+	}
+}
+
+func TestCacheReturnsSameTable(t *testing.T) {
+	a := Cache("foo")
+	if a == nil {
+		t.Fatal("Cache returned nil for a new table")
+	}
+	if b := Cache("foo"); b != a {
+		t.Error("Cache returned a different table for the same name")
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	fill := func(name string, p EvictionPolicy) *CacheTable {
+		table := Cache(name)
+		table.SetCapacity(3)
+		table.SetEvictionPolicy(p)
+		for i := 0; i < 3; i++ {
+			table.Add(i, 0, v)
+			time.Sleep(time.Millisecond)
+		}
+		// 0 is the oldest but most used, 2 the most recently used
+		table.Value(0)
+		table.Value(0)
+		time.Sleep(time.Millisecond)
+		table.Value(1)
+		time.Sleep(time.Millisecond)
+		table.Value(2)
+		table.Add(3, 0, v)
+		return table
+	}
+
+	for _, tc := range []struct {
+		name    string
+		policy  EvictionPolicy
+		evicted int
+	}{
+		{"testEvictionPolicyLRU", EvictLRU, 0},
+		{"testEvictionPolicyLFU", EvictLFU, 1},
+		{"testEvictionPolicyFIFO", EvictFIFO, 0},
+	} {
+		table := fill(tc.name, tc.policy)
+		if table.Count() != 3 || table.Exists(tc.evicted) {
+			t.Error("Wrong item evicted for policy", tc.policy, table.Count())
+		}
+	}
+
+	// switching policy on a populated table affects the next eviction
+	// after this 2 is the most recently used but least frequently used item
+	table := fill("testEvictionPolicySwitch", EvictLRU)
+	for _, key := range []int{1, 1, 3, 3, 3} {
+		table.Value(key)
+	}
+	time.Sleep(time.Millisecond)
+	table.Value(2)
+	table.SetEvictionPolicy(EvictLFU)
+	table.Add(4, 0, v)
+	if table.Count() != 3 || table.Exists(2) || !table.Exists(1) {
+		t.Error("Eviction did not follow the new policy", table.Count())
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	table := Cache("testApproxCount")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := g*1000 + i%50
+				table.Add(key, 0, v)
+				if i%3 == 0 {
+					table.Delete(key)
+				}
+				table.ApproxCount()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// each key's last operation decides whether it is still cached
+	expected := 0
+	for i := 450; i < 500; i++ {
+		if i%3 != 0 {
+			expected += 4
+		}
+	}
+	if table.Count() != expected {
+		t.Error("Count does not match the items left after churn", table.Count(), expected)
+	}
+	if n := table.ApproxCount(); n != int64(table.Count()) {
+		t.Error("ApproxCount did not converge to Count", n, table.Count())
+	}
+}
+
+func TestCacheSmoke(t *testing.T) {
+	table := Cache("t")
+	if table == nil || cache["t"] != table {
+		t.Fatal("Cache did not register the table in the package registry")
+	}
+	table.Add(k, 0, v)
+	if p, err := table.Value(k); err != nil || p.Data() != v {
+		t.Error("Error using a table created by Cache", err)
+	}
+}
+
+func TestCapacityEvictionPanic(t *testing.T) {
+	table := Cache("testCapacityEvictionPanic")
+	table.SetCapacity(1)
+	table.Add(1, 0, v)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		panic("callback failed")
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the eviction callback to panic")
+			}
+		}()
+		table.Add(2, 0, v)
+	}()
+
+	// the table lock must have been released
+	done := make(chan bool)
+	go func() {
+		table.SetAboutToDeleteItemCallback(nil)
+		done <- table.Exists(2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Table still locked after a panicking eviction")
+	}
+}
+
+func TestCapacityTracking(t *testing.T) {
+	table := Cache("testCapacityTracking")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	table.Value(0)
+
+	// enabling capacity on a populated table rebuilds the order from item stats
+	table.SetCapacity(5)
+	table.Add(5, 0, v)
+	if table.Exists(1) || !table.Exists(0) {
+		t.Error("Eviction order not rebuilt from existing items")
+	}
+
+	// replacing, deleting and flushing keep the order consistent
+	table.Add(2, 0, v)
+	table.Delete(3)
+	table.Add(6, 0, v)
+	table.Add(7, 0, v)
+	if table.Count() != 5 || table.Exists(4) {
+		t.Error("Eviction order out of sync after replace and delete", table.Count())
+	}
+	table.Flush()
+	for i := 0; i < 6; i++ {
+		table.Add(i, 0, v)
+	}
+	if table.Count() != 5 || table.Exists(0) {
+		t.Error("Eviction order out of sync after flush", table.Count())
+	}
+}
+
+func TestTouchUnderAbsoluteExpiration(t *testing.T) {
+	table := Cache("testTouchUnderAbsoluteExpiration")
+	table.SetExpirationPolicy(ExpireAbsolute)
+	table.Add(k, 100*time.Millisecond, v)
+
+	// reads do not extend absolute lifetimes, so remaining life keeps shrinking
+	time.Sleep(60 * time.Millisecond)
+	table.Value(k)
+	touched, err := table.TouchIfBelow(k, 50*time.Millisecond, 100*time.Millisecond)
+	if err != nil || !touched {
+		t.Error("TouchIfBelow ignored remaining life under absolute expiration", touched, err)
+	}
+
+	// the touch restarts the absolute lifetime
+	time.Sleep(60 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Touched item expired under absolute expiration")
+	}
+	if _, err := table.UpdateFunc(k, 100*time.Millisecond, func(old interface{}) interface{} { return old }); err != nil {
+		t.Error("Error updating item", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Updated item expired under absolute expiration")
+	}
+}
+
+func TestValidatorKeepsReplacedItem(t *testing.T) {
+	table := Cache("testValidatorKeepsReplacedItem")
+	table.Add(k, 0, "stale")
+	replaced := false
+	table.SetValidator(func(item *CacheItem) bool {
+		if item.Data() != "stale" {
+			return true
+		}
+		// a concurrent Add replaces the rejected item before it is deleted
+		if !replaced {
+			replaced = true
+			table.Add(k, 0, "fresh")
+		}
+		return false
+	})
+
+	table.Value(k)
+	p, err := table.Value(k)
+	if err != nil || p.Data() != "fresh" {
+		t.Error("Rejecting a stale item deleted its replacement", err)
+	}
+}
+
+func TestSoftDeleteSameKey(t *testing.T) {
+	table := Cache("testSoftDeleteSameKey")
+	table.SetSoftDeleteWindow(time.Minute)
+	var deleted []interface{}
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted = append(deleted, item.Data())
+	})
+
+	// soft-deleting over a pending entry purges the old item with callbacks
+	table.Add(k, 0, "old")
+	table.SoftDelete(k)
+	table.Add(k, 0, "new")
+	if err := table.Undelete(k); err != ErrKeyExists {
+		t.Error("Undelete overwrote a live item", err)
+	}
+	if p, err := table.Value(k); err != nil || p.Data() != "new" {
+		t.Error("Live item changed by failed Undelete", err)
+	}
+	table.SoftDelete(k)
+	if len(deleted) != 1 || deleted[0] != "old" {
+		t.Error("Old soft-deleted item was not purged with callbacks", deleted)
+	}
+	if err := table.Undelete(k); err != nil {
+		t.Error("Error undeleting the newer item", err)
+	}
+	if p, err := table.Value(k); err != nil || p.Data() != "new" {
+		t.Error("Undelete restored the wrong item", err)
+	}
+}
+
+func TestRefreshTopLifeSpan(t *testing.T) {
+	table := Cache("testRefreshTopLifeSpan")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 30*time.Millisecond, v+"_fresh")
+	})
+	table.Add(k, 0, v)
+	table.Value(k)
+
+	// the shorter reloaded lifespan is enforced without any other check
+	table.RefreshTop(1)
+	time.Sleep(80 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Reloaded lifespan was not enforced")
+	}
+}
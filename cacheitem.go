@@ -1,6 +1,7 @@
 package cache2go
 
 import (
+    "container/list"
     "sync"
     "time"
 )
@@ -24,11 +25,52 @@ type CacheItem struct {
     //缓存上次访问时间，时间戳
     accessedOn time.Time
 
+    //缓存数据上次修改时间，时间戳，读取缓存不会更新
+    modifiedOn time.Time
+
     //缓存被访问的次数
     accessCount int64
 
+    //缓存数据被修改的次数，不包括创建
+    writeCount int64
+
+    //最近的访问时间，环形缓冲区，长度为 0 时不记录
+    accessHistory []time.Time
+    accessHistoryNext int
+    accessHistoryCount int
+
+    //通过 AddRW 添加时为 true，读取后生命期设为 readSpan，修改后设为 writeSpan，添加后不再修改
+    readWrite bool
+    readSpan time.Duration
+    writeSpan time.Duration
+
+    //添加到缓存表时分配的递增序号，只在持有缓存表锁时访问
+    seq int64
+
+    //所属的缓存表，访问后用于更新淘汰顺序，只在持有缓存项锁时访问
+    table *CacheTable
+
+    //在缓存表淘汰顺序中的位置，以及 LFU 排序时使用的访问次数和访问时间
+    //只在持有缓存表的 evictionMutex 时访问，没有跟踪时 lruElem 为 nil
+    lruElem *list.Element
+    fifoElem *list.Element
+    lfuIndex int
+    lfuCount int64
+    lfuAccessedOn time.Time
+
+    //上次过期检查时看到的访问时间，只在持有缓存表锁时访问
+    checkedAccessedOn time.Time
+
     //缓存项被删除之前执行的回调函数
     aboutToExpire func(key interface{})
+
+    //每次 KeepAlive 后执行的回调函数，参数为更新前的访问时间
+    keepAlive func(item *CacheItem, previousAccessedOn time.Time)
+
+    //访问次数达到 accessThreshold 时执行一次的回调函数
+    accessThreshold int64
+    accessThresholdCallback func(item *CacheItem)
+    accessThresholdFired bool
 }
 
 //初始化一个 CacheItem 类型的变量，并返回该变量(CacheItem类型)的指针
@@ -39,25 +81,127 @@ func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *Ca
         lifeSpan:      lifeSpan,
         createdOn:     t,
         accessedOn:    t,
+        modifiedOn:    t,
         accessCount:   0,
         aboutToExpire: nil,
         data:          data,
     }
 }
 
+//修改缓存数据，更新修改时间和修改次数，调用前必须锁定缓存项
+//通过 AddRW 添加的缓存项生命期重置为 writeSpan
+func (item *CacheItem) setData(data interface{}) {
+    item.data = data
+    item.modifiedOn = time.Now()
+    item.writeCount++
+    if item.readWrite {
+        item.lifeSpan = item.writeSpan
+        item.accessedOn = item.modifiedOn
+    }
+}
+
+//按过期策略返回剩余生命期，已过期时小于等于 0，调用前必须锁定缓存项
+//滑动过期从上次访问时间开始计算，绝对过期从创建时间开始计算
+func (item *CacheItem) remainingLife(policy ExpirationPolicy, now time.Time) time.Duration {
+    since := item.accessedOn
+    if policy == ExpireAbsolute {
+        since = item.createdOn
+    }
+    return item.lifeSpan - now.Sub(since)
+}
+
+//按过期策略从 now 开始重新计算生命期，绝对过期时同时重置创建时间，调用前必须锁定缓存项
+func (item *CacheItem) touch(policy ExpirationPolicy, now time.Time) {
+    item.accessedOn = now
+    if policy == ExpireAbsolute {
+        item.createdOn = now
+    }
+}
+
+//返回缓存项的副本，副本有自己的锁，不带任何回调函数，copyData 不为 nil 时用于复制数据
+func (item *CacheItem) copy(copyData func(interface{}) interface{}) *CacheItem {
+    item.RLock()
+    defer item.RUnlock()
+    data := item.data
+    if copyData != nil {
+        data = copyData(data)
+    }
+    return &CacheItem{
+        key:         item.key,
+        data:        data,
+        lifeSpan:    item.lifeSpan,
+        createdOn:   item.createdOn,
+        accessedOn:  item.accessedOn,
+        modifiedOn:  item.modifiedOn,
+        accessCount: item.accessCount,
+        writeCount:  item.writeCount,
+    }
+}
+
 //每次访问后，更新缓存key的最后访问时间，访问总次数，维活缓存key
 func (item *CacheItem) KeepAlive() {
     item.Lock()
-    defer item.Unlock()
+    previousAccessedOn := item.accessedOn
     item.accessedOn = time.Now()
     item.accessCount++
+    if item.readWrite {
+        item.lifeSpan = item.readSpan
+    }
+    if size := len(item.accessHistory); size > 0 {
+        item.accessHistory[item.accessHistoryNext] = item.accessedOn
+        item.accessHistoryNext = (item.accessHistoryNext + 1) % size
+        if item.accessHistoryCount < size {
+            item.accessHistoryCount++
+        }
+    }
+    //访问次数达到阈值时执行一次回调函数，回调在锁外执行
+    var thresholdCallback func(*CacheItem)
+    if item.accessThresholdCallback != nil && !item.accessThresholdFired && item.accessCount >= item.accessThreshold {
+        item.accessThresholdFired = true
+        thresholdCallback = item.accessThresholdCallback
+    }
+    keepAliveCallback := item.keepAlive
+    table := item.table
+    item.Unlock()
+    if table != nil {
+        table.touchEviction(item)
+    }
+    if keepAliveCallback != nil {
+        keepAliveCallback(item, previousAccessedOn)
+    }
+    if thresholdCallback != nil {
+        thresholdCallback(item)
+    }
+}
+
+//重置缓存key的创建时间和上次访问时间，相当于重新创建，数据和访问次数保持不变
+//缓存过期是按上次访问时间计算的，重置后缓存key重新获得完整的生命期
+func (item *CacheItem) Rebirth() {
+    item.Lock()
+    t := time.Now()
+    item.createdOn = t
+    item.accessedOn = t
+    table := item.table
+    item.Unlock()
+    if table != nil {
+        table.touchEviction(item)
+    }
 }
 
 //返回缓存key的生命期
 func (item *CacheItem) LifeSpan() time.Duration {
+    item.RLock()
+    defer item.RUnlock()
     return item.lifeSpan
 }
 
+//设置缓存key的生命期，缓存表不会知道这个修改，需要调用缓存表的 RecomputeExpiration 重新安排过期检查
+func (item *CacheItem) SetLifeSpan(d time.Duration) {
+    item.Lock()
+    defer item.Unlock()
+    item.lifeSpan = d
+}
+
 //返回缓存key的上次访问时间
 func (item *CacheItem) AccessedOn() time.Time {
     item.Lock()
@@ -67,9 +211,51 @@ func (item *CacheItem) AccessedOn() time.Time {
 
 //返回缓存key的创建时间
 func (item *CacheItem) CreatedOn() time.Time {
+    item.RLock()
+    defer item.RUnlock()
     return item.createdOn
 }
 
+//返回缓存数据的上次修改时间
+func (item *CacheItem) ModifiedOn() time.Time {
+    item.RLock()
+    defer item.RUnlock()
+    return item.modifiedOn
+}
+
+//返回缓存key从创建到现在的时长
+func (item *CacheItem) Age() time.Duration {
+    item.RLock()
+    defer item.RUnlock()
+    return time.Since(item.createdOn)
+}
+
+//返回缓存key从上次访问到现在的空闲时长
+func (item *CacheItem) IdleTime() time.Duration {
+    item.RLock()
+    defer item.RUnlock()
+    return time.Since(item.accessedOn)
+}
+
+//返回缓存数据被修改的次数
+func (item *CacheItem) WriteCount() int64 {
+    item.RLock()
+    defer item.RUnlock()
+    return item.writeCount
+}
+
+//返回最近的访问时间，按访问顺序排列，需要通过缓存表的 SetAccessHistorySize 开启
+func (item *CacheItem) AccessHistory() []time.Time {
+    item.RLock()
+    defer item.RUnlock()
+    size := len(item.accessHistory)
+    r := make([]time.Time, item.accessHistoryCount)
+    for i := range r {
+        r[i] = item.accessHistory[(item.accessHistoryNext-item.accessHistoryCount+i+size)%size]
+    }
+    return r
+}
+
 //返回缓存key的访问次数
 func (item *CacheItem) AccessCount() int64 {
     item.Lock()
@@ -84,9 +270,54 @@ func (item *CacheItem) Key() interface{} {
 
 //返回缓存记录的value
 func (item *CacheItem) Data() interface{} {
+    item.RLock()
+    defer item.RUnlock()
     return item.data
 }
 
+//返回 string 类型的缓存value，类型不匹配时 ok 为 false
+func (item *CacheItem) DataString() (string, bool) {
+    item.RLock()
+    defer item.RUnlock()
+    s, ok := item.data.(string)
+    return s, ok
+}
+
+//返回 int64 类型的缓存value，类型不匹配时 ok 为 false
+func (item *CacheItem) DataInt64() (int64, bool) {
+    item.RLock()
+    defer item.RUnlock()
+    n, ok := item.data.(int64)
+    return n, ok
+}
+
+//返回 []byte 类型的缓存value 的副本，修改返回值不影响缓存，类型不匹配时 ok 为 false
+func (item *CacheItem) DataBytes() ([]byte, bool) {
+    item.RLock()
+    defer item.RUnlock()
+    b, ok := item.data.([]byte)
+    if !ok {
+        return nil, false
+    }
+    return append([]byte(nil), b...), true
+}
+
+//设置访问次数达到 threshold 时的回调函数，回调函数只执行一次
+func (item *CacheItem) SetAccessThresholdCallback(threshold int64, f func(*CacheItem)) {
+    item.Lock()
+    defer item.Unlock()
+    item.accessThreshold = threshold
+    item.accessThresholdCallback = f
+    item.accessThresholdFired = false
+}
+
+//设置每次访问维活缓存key后的回调函数，回调在锁外执行，可以从中读取缓存项
+func (item *CacheItem) SetKeepAliveCallback(f func(item *CacheItem, previousAccessedOn time.Time)) {
+    item.Lock()
+    defer item.Unlock()
+    item.keepAlive = f
+}
+
 //设置缓存key被删除时的回调函数，回调函数会在缓存被删除之前调用
 func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
     item.Lock()
@@ -1,10 +1,20 @@
 package cache2go
 
 import (
+    "container/heap"
+    "container/list"
+    "fmt"
+    "io"
     "log"
+    "math"
+    "math/rand"
+    "reflect"
+    "runtime"
     "sort"
+    "strings"
     "time"
     "sync"
+    "sync/atomic"
 )
 
 //缓存表 cachetable 结构
@@ -14,25 +24,275 @@ type CacheTable struct {
     name string
     //所有缓存记录
     items map[interface{}]*CacheItem
+    //软删除的缓存记录，在 softDeleteWindow 内可以恢复，值为缓存项和软删除时间
+    softDeleted map[interface{}]softDeletedItem
+    //软删除的缓存记录可以恢复的时长
+    softDeleteWindow time.Duration
+    //下一个添加的缓存项的序号
+    nextSeq int64
+    //缓存记录条数，在每次添加和删除时维护，读取时不需要加锁
+    count atomic.Int64
+    //Value 调用命中和没有命中的次数，以及超过容量被淘汰的缓存项数量
+    hits      atomic.Int64
+    misses    atomic.Int64
+    evictions atomic.Int64
     // 触发缓存清理的定时器
     cleanupTimer *time.Timer
     // 缓存清理周期
     cleanupInterval time.Duration
+    // 缓存清理周期的下限，避免过期时间相近的缓存项导致频繁清理
+    minCleanupInterval time.Duration
+    // 缓存项过期时间的计算方式
+    expirationPolicy ExpirationPolicy
+    // 过期检查开始前调用，返回 false 时跳过本次检查
+    sweepGuard func() bool
+    // 过期检查中的 panic 被恢复后调用
+    panicHandler func(recovered interface{})
+    //返回缓存数据字节数的函数，用于 WriteMetrics 输出缓存大小
+    sizeFunc func(data interface{}) int64
     //缓存表日志
     logger *log.Logger
+    //日志中把缓存key转换为字符串的函数
+    keyStringer func(key interface{}) string
+    //缓存项在即将过期前被访问而免于过期的次数
+    keepAliveSaves int64
+    //缓存表中随机功能使用的随机数生成器
+    rnd *rand.Rand
+    //MostAccessed 等统计分析方法最多检查的缓存项数量，0 表示不限制
+    maxAnalysisItems int
+    //缓存项数量上限，超过时按 evictionPolicy 淘汰缓存项，0 表示不限制
+    capacity int
+    evictionPolicy EvictionPolicy
+    //capacity 大于 0 时维护的淘汰顺序：按访问顺序、按添加顺序和按访问次数排列
+    //由 evictionMutex 保护，访问缓存项后更新顺序不需要缓存表写锁
+    evictionTracking atomic.Bool
+    lruList *list.List
+    fifoList *list.List
+    lfuHeap lfuHeap
+    evictionMutex sync.Mutex
+    //添加缓存后同步写入外部存储的函数
+    writeThrough func(key interface{}, data interface{}, lifeSpan time.Duration) error
+    //为 true 时同步写入失败会撤销内存中的修改
+    writeThroughStrict bool
     //访问不存在的key时的回调函数
     loadData func(key interface{}, args ...interface{}) *CacheItem
+    //访问不存在的key时的回调函数，可以返回错误，设置后优先于 loadData
+    loadDataE func(key interface{}, args ...interface{}) (*CacheItem, error)
+    //调用 loadData 时默认传入的参数
+    loaderArgs []interface{}
+    //为 true 时拒绝 loadData 返回的永久缓存项（lifeSpan 为 0）
+    rejectPermanentLoads bool
+    //调用 loadData 的超时时长，0 表示不限制
+    loaderTimeout time.Duration
+    //返回 false 的缓存key不调用 loadData 加载
+    loaderKeyFilter func(key interface{}) bool
+    //每个缓存项保留的最近访问时间数量，0 表示不记录
+    accessHistorySize int
+    //添加缓存时把缓存数据替换为共享实例的函数
+    valueInterner func(data interface{}) interface{}
+    //新缓存项添加到缓存表之前执行的初始化函数
+    itemInitializer func(item *CacheItem)
     //添加一个新的缓存key时的回调函数
     addedItem func(item *CacheItem)
+    //批量添加缓存时的回调函数，设置后 AddBatch 不再逐条调用 addedItem
+    bulkAddedItem func(items []*CacheItem)
     //删除任一条记录时的回调函数
     aboutToDeleteItem func(item *CacheItem)
+    //删除缓存项后剩余数量降到 lowWaterThreshold 及以下时的回调函数
+    lowWater func(remaining int)
+    lowWaterThreshold int
+    //本次降到阈值以下后是否已执行过回调函数，缓存项数量回到阈值以上时重置
+    lowWaterFired bool
+    //为 true 时 UpdateFunc 在缓存项不存在时创建缓存项
+    updateFuncCreates bool
+    //CopyItem 复制缓存数据的函数，为 nil 时只复制数据的引用
+    copyData func(data interface{}) interface{}
+    //缓存项被垃圾回收时执行的函数，用于排查删除后仍被引用的缓存项
+    itemFinalizer func(key interface{})
+    //Value 读取缓存时检查缓存项是否仍然有效的函数
+    validator func(item *CacheItem) bool
+    //最近的修改记录，环形缓冲区，长度为 0 时不记录
+    mutations []Mutation
+    //下一条修改记录写入的位置
+    mutationNext int
+    //已记录的修改数量，不超过 len(mutations)
+    mutationCount int
+    //最近 Value 调用的结果，环形缓冲区，用于计算最近的命中率
+    recentReads []recentRead
+    recentReadsNext int
+    recentReadsCount int
+    //保护 recentReads，避免 Value 需要加缓存表写锁
+    recentReadsMutex sync.Mutex
+    //每种回调函数的执行次数和耗时
+    callbackDurations map[string]CallbackDuration
+    //保护 callbackDurations，回调函数在缓存表锁外执行
+    callbackDurationsMutex sync.Mutex
+    //按缓存key加的互斥锁，没有goroutine持有或等待时删除
+    keyLocks map[interface{}]*keyLock
+    //保护 keyLocks
+    keyLocksMutex sync.Mutex
 }
 
-//返回缓存表中的缓存记录总条数
+//缓存项过期时间的计算方式
+type ExpirationPolicy int
+
+const (
+    //从上次访问时间开始计算生命期，每次访问都会延长，即空闲 lifeSpan 后过期（默认）
+    ExpireSliding ExpirationPolicy = iota
+    //从创建时间开始计算生命期，访问不会延长，Rebirth 会重置创建时间
+    ExpireAbsolute
+)
+
+//缓存项数量超过上限时选择淘汰哪个缓存项
+type EvictionPolicy int
+
+const (
+    //淘汰最久没有访问的缓存项（默认）
+    EvictLRU EvictionPolicy = iota
+    //淘汰访问次数最少的缓存项，次数相同时淘汰最久没有访问的
+    EvictLFU
+    //淘汰最早添加的缓存项
+    EvictFIFO
+)
+
+//按访问次数从少到多排列缓存项的最小堆，次数相同时最久没有访问的在前
+type lfuHeap []*CacheItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+    return h[i].lfuCount < h[j].lfuCount ||
+        h[i].lfuCount == h[j].lfuCount && h[i].lfuAccessedOn.Before(h[j].lfuAccessedOn)
+}
+func (h lfuHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].lfuIndex = i
+    h[j].lfuIndex = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+    item := x.(*CacheItem)
+    item.lfuIndex = len(*h)
+    *h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+    old := *h
+    item := old[len(old)-1]
+    old[len(old)-1] = nil
+    *h = old[:len(old)-1]
+    return item
+}
+
+//修改记录的操作类型
+const (
+    MutationAdd    = "add"
+    MutationDelete = "delete"
+)
+
+//批量添加时同一批中出现重复key的处理方式
+type DuplicatePolicy int
+
+const (
+    //保留最后一个
+    DuplicateLastWins DuplicatePolicy = iota
+    //保留第一个
+    DuplicateFirstWins
+    //返回 ErrDuplicateKey，不添加任何缓存项
+    DuplicateError
+)
+
+//缓存表的一条修改记录
+type Mutation struct {
+    Key  interface{}
+    Op   string
+    Time time.Time
+}
+
+//缓存表的配置快照，回调函数只表示是否设置
+type TableConfig struct {
+    Name                 string
+    MinCleanupInterval   time.Duration
+    ExpirationPolicy     ExpirationPolicy
+    SoftDeleteWindow     time.Duration
+    MaxAnalysisItems     int
+    Capacity             int
+    EvictionPolicy       EvictionPolicy
+    MutationLogSize      int
+    AccessHistorySize    int
+    LowWaterThreshold    int
+    DefaultLoaderArgs    []interface{}
+    LoaderTimeout        time.Duration
+    WriteThroughStrict   bool
+    RejectPermanentLoads bool
+    UpdateFuncCreates    bool
+
+    HasLogger            bool
+    HasKeyStringer       bool
+    HasDataLoader        bool
+    HasDataLoaderE       bool
+    HasLoaderKeyFilter   bool
+    HasWriteThrough      bool
+    HasValueInterner     bool
+    HasItemInitializer   bool
+    HasAddedItem         bool
+    HasBulkAddedItem     bool
+    HasAboutToDeleteItem bool
+    HasLowWater          bool
+    HasDataCopier        bool
+    HasItemFinalizer     bool
+    HasValidator         bool
+    HasPanicHandler      bool
+    HasSizeFunc          bool
+}
+
+//软删除的缓存项
+type softDeletedItem struct {
+    item      *CacheItem
+    deletedOn time.Time
+}
+
+//计算最近命中率时保留的 Value 调用结果数量
+const recentReadsSize = 1024
+
+//一次 Value 调用的结果，hit 表示直接从缓存中读取
+type recentRead struct {
+    at  time.Time
+    hit bool
+}
+
+//统计执行耗时的回调函数类型
+const (
+    CallbackAddedItem         = "addedItem"
+    CallbackBulkAddedItem     = "bulkAddedItem"
+    CallbackAboutToDeleteItem = "aboutToDeleteItem"
+)
+
+//一种回调函数的执行次数、总耗时和最大耗时
+type CallbackDuration struct {
+    Calls int64
+    Total time.Duration
+    Max   time.Duration
+}
+
+//过期检查被 sweepGuard 跳过或 panic 且没有设置清理周期下限时，重新检查的间隔
+const sweepRetryInterval = time.Second
+
+//缓存key的互斥锁，refs 为持有和等待该锁的goroutine数量
+type keyLock struct {
+    sync.Mutex
+    refs int
+}
+
+//返回缓存表中的缓存记录总条数，读取添加和删除时维护的计数
+//计数只在锁定缓存表时修改，加读锁读取的结果是准确的
 func (table *CacheTable) Count() int {
-    table.Lock()
-    defer table.Unlock()
-    return len(table.items)
+    table.RLock()
+    defer table.RUnlock()
+    return int(table.count.Load())
+}
+
+//不加锁返回维护的缓存记录条数，用于频繁采集的指标，读锁本身也会产生竞争
+//与其他goroutine的添加和删除同时调用时可能略有偏差，需要准确的条数时使用 Count
+func (table *CacheTable) ApproxCount() int64 {
+    return table.count.Load()
 }
 
 //循环遍历缓存中所有记录，并对记录执行某操作
@@ -44,6 +304,124 @@ func (table *CacheTable) Foreach(trans func(key interface{}, value *CacheItem))
     }
 }
 
+//在锁内依次把所有缓存项合并到 acc 中，返回最终结果
+//fn 在缓存表锁内执行，不能调用缓存表的方法
+func (table *CacheTable) Reduce(acc interface{}, fn func(acc interface{}, key interface{}, item *CacheItem) interface{}) interface{} {
+    table.RLock()
+    defer table.RUnlock()
+    for k, v := range table.items {
+        acc = fn(acc, k, v)
+    }
+    return acc
+}
+
+//循环遍历缓存中最多 limit 条记录，并对记录执行某操作
+//map 的遍历顺序是随机的，可以用来抽样
+func (table *CacheTable) ForeachLimit(limit int, trans func(key interface{}, value *CacheItem)) {
+    table.Lock()
+    defer table.Unlock()
+    n := 0
+    for k, v := range table.items {
+        if n >= limit {
+            break
+        }
+        trans(k, v)
+        n++
+    }
+}
+
+//返回缓存项在即将过期前被访问而免于过期的次数
+func (table *CacheTable) KeepAliveSaves() int64 {
+    table.RLock()
+    defer table.RUnlock()
+    return table.keepAliveSaves
+}
+
+//返回缓存表当前的配置快照
+func (table *CacheTable) Config() TableConfig {
+    table.RLock()
+    defer table.RUnlock()
+    return TableConfig{
+        Name:                 table.name,
+        MinCleanupInterval:   table.minCleanupInterval,
+        ExpirationPolicy:     table.expirationPolicy,
+        SoftDeleteWindow:     table.softDeleteWindow,
+        MaxAnalysisItems:     table.maxAnalysisItems,
+        Capacity:             table.capacity,
+        EvictionPolicy:       table.evictionPolicy,
+        MutationLogSize:      len(table.mutations),
+        AccessHistorySize:    table.accessHistorySize,
+        LowWaterThreshold:    table.lowWaterThreshold,
+        DefaultLoaderArgs:    append([]interface{}(nil), table.loaderArgs...),
+        LoaderTimeout:        table.loaderTimeout,
+        WriteThroughStrict:   table.writeThroughStrict,
+        RejectPermanentLoads: table.rejectPermanentLoads,
+        UpdateFuncCreates:    table.updateFuncCreates,
+
+        HasLogger:            table.logger != nil,
+        HasKeyStringer:       table.keyStringer != nil,
+        HasDataLoader:        table.loadData != nil,
+        HasDataLoaderE:       table.loadDataE != nil,
+        HasLoaderKeyFilter:   table.loaderKeyFilter != nil,
+        HasWriteThrough:      table.writeThrough != nil,
+        HasValueInterner:     table.valueInterner != nil,
+        HasItemInitializer:   table.itemInitializer != nil,
+        HasAddedItem:         table.addedItem != nil,
+        HasBulkAddedItem:     table.bulkAddedItem != nil,
+        HasAboutToDeleteItem: table.aboutToDeleteItem != nil,
+        HasLowWater:          table.lowWater != nil,
+        HasDataCopier:        table.copyData != nil,
+        HasItemFinalizer:     table.itemFinalizer != nil,
+        HasValidator:         table.validator != nil,
+        HasPanicHandler:      table.panicHandler != nil,
+        HasSizeFunc:          table.sizeFunc != nil,
+    }
+}
+
+//设置缓存表中所有随机功能（抽样等）使用的随机数源，相同的种子得到相同的随机序列
+//不设置时使用以当前时间为种子的随机数源
+func (table *CacheTable) SetRandSource(src rand.Source) {
+    table.Lock()
+    defer table.Unlock()
+    table.rnd = rand.New(src)
+}
+
+//设置缓存项数量上限，添加缓存后数量超过 max 时按淘汰策略（默认 EvictLRU）淘汰缓存项，0 表示不限制
+//淘汰和删除一样执行删除回调函数，已有的缓存项在下一次添加时才会被淘汰
+func (table *CacheTable) SetCapacity(max int) {
+    table.Lock()
+    defer table.Unlock()
+    table.capacity = max
+    table.evictionMutex.Lock()
+    defer table.evictionMutex.Unlock()
+    tracking := table.evictionTracking.Load()
+    if max > 0 && !tracking {
+        table.rebuildEviction()
+    } else if max <= 0 && tracking {
+        for _, item := range table.items {
+            table.untrackItem(item)
+        }
+        table.evictionTracking.Store(false)
+    }
+}
+
+//设置超过容量时的淘汰策略，与 SetCapacity 一起使用
+//淘汰依据的访问时间、访问次数和添加顺序每个缓存项都有记录，修改策略后直接对之后的添加生效，
+//不会立即淘汰已有的缓存项
+func (table *CacheTable) SetEvictionPolicy(p EvictionPolicy) {
+    table.Lock()
+    defer table.Unlock()
+    table.evictionPolicy = p
+}
+
+//设置统计分析方法（如 MostAccessed）最多检查的缓存项数量，0 表示不限制
+//缓存项数量超过 n 时只检查按map遍历顺序取到的 n 项，结果是近似的
+func (table *CacheTable) SetMaxAnalysisItems(n int) {
+    table.Lock()
+    defer table.Unlock()
+    table.maxAnalysisItems = n
+}
+
 //设置访问不存在的缓存key时的回调函数
 func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *CacheItem) {
     table.Lock()
@@ -51,6 +429,69 @@ func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *Cach
     table.loadData = f
 }
 
+//设置访问不存在的缓存key时的回调函数，回调函数返回的错误会包装后返回给 Value 的调用方
+//设置后优先于 SetDataLoader 设置的回调函数
+func (table *CacheTable) SetDataLoaderE(f func(interface{}, ...interface{}) (*CacheItem, error)) {
+    table.Lock()
+    defer table.Unlock()
+    table.loadDataE = f
+}
+
+//设置调用 loadData 时默认传入的参数
+//Value 传入的参数按位置覆盖默认参数，超出 Value 参数个数的默认参数追加在后面
+func (table *CacheTable) SetDefaultLoaderArgs(args ...interface{}) {
+    table.Lock()
+    defer table.Unlock()
+    table.loaderArgs = args
+}
+
+//设置是否拒绝 loadData 返回的永久缓存项（lifeSpan 为 0）
+//拒绝时 Value 返回 ErrPermanentLoad，缓存项不会添加到缓存表
+func (table *CacheTable) SetRejectPermanentLoads(reject bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.rejectPermanentLoads = reject
+}
+
+//设置调用 loadData 的超时时长，超时后 Value 返回 ErrLoaderTimeout，0 表示不限制
+//超时的 loadData 调用仍在后台执行完，结果被丢弃，不会添加到缓存表
+func (table *CacheTable) SetLoaderTimeout(d time.Duration) {
+    table.Lock()
+    defer table.Unlock()
+    table.loaderTimeout = d
+}
+
+//设置加载缓存key前的过滤函数，f 返回 false 时不调用 loadData，Value 直接返回 ErrKeyNotFound
+func (table *CacheTable) SetLoaderKeyFilter(f func(key interface{}) bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.loaderKeyFilter = f
+}
+
+//设置每个缓存项保留的最近访问时间数量，0 表示不记录，只对之后添加的缓存项生效
+//开启后每个缓存项都要额外占用内存，默认关闭
+func (table *CacheTable) SetAccessHistorySize(n int) {
+    table.Lock()
+    defer table.Unlock()
+    table.accessHistorySize = n
+}
+
+//设置添加缓存时把缓存数据替换为共享实例的函数，用于让相等的缓存数据共用同一个实例以节省内存
+//返回值必须与原数据相等，在缓存表锁内执行，不能调用缓存表的方法
+func (table *CacheTable) SetValueInterner(f func(interface{}) interface{}) {
+    table.Lock()
+    defer table.Unlock()
+    table.valueInterner = f
+}
+
+//设置新缓存项添加到缓存表之前执行的初始化函数，用于统一设置回调函数等
+//对 Add、AddBatch、loadData 加载等所有添加路径生效，在缓存表锁内执行，不能调用缓存表的方法
+func (table *CacheTable) SetItemInitializer(f func(*CacheItem)) {
+    table.Lock()
+    defer table.Unlock()
+    table.itemInitializer = f
+}
+
 //设置添加新的缓存item时的回调函数
 func (table *CacheTable) SetAddedItemCallback(f func(*CacheItem)) {
     table.Lock()
@@ -58,6 +499,14 @@ func (table *CacheTable) SetAddedItemCallback(f func(*CacheItem)) {
     table.addedItem = f
 }
 
+//设置批量添加缓存时的回调函数，AddBatch 添加完成后以所有新增缓存项调用一次
+//不设置（nil）时 AddBatch 对每条缓存项调用 addedItem
+func (table *CacheTable) SetBulkAddedCallback(f func([]*CacheItem)) {
+    table.Lock()
+    defer table.Unlock()
+    table.bulkAddedItem = f
+}
+
 //设置缓存记录被删除时执行的回调函数
 func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
     table.Lock()
@@ -65,6 +514,79 @@ func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
     table.aboutToDeleteItem = f
 }
 
+//设置添加缓存时同步写入外部存储的函数，Add/AddRW/NotFoundAdd 写入内存之后调用
+//通过 loadData 加载的缓存本来就来自外部，不会写回
+//默认写入失败只记录日志，内存中的缓存保持不变
+func (table *CacheTable) SetWriteThrough(f func(key interface{}, data interface{}, lifeSpan time.Duration) error) {
+    table.Lock()
+    defer table.Unlock()
+    table.writeThrough = f
+}
+
+//设置是否严格同步写入，严格模式下先写入外部存储，成功后才写入内存
+//写入失败时缓存表保持不变，不执行添加回调，也不会因超过容量淘汰缓存项
+func (table *CacheTable) SetWriteThroughStrict(strict bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.writeThroughStrict = strict
+}
+
+//设置删除缓存项后剩余数量降到 threshold 及以下时的回调函数
+//每次降到阈值以下只执行一次，缓存项数量回到阈值以上后才会再次执行
+func (table *CacheTable) SetLowWaterCallback(threshold int, f func(remaining int)) {
+    table.Lock()
+    defer table.Unlock()
+    table.lowWaterThreshold = threshold
+    table.lowWater = f
+    table.lowWaterFired = false
+}
+
+//设置 UpdateFunc 在缓存项不存在时是否创建缓存项，创建时以 nil 调用更新函数
+func (table *CacheTable) SetUpdateFuncCreates(create bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.updateFuncCreates = create
+}
+
+//设置 CopyItem 复制缓存数据的函数，不设置时副本和缓存项共享同一份数据
+func (table *CacheTable) SetDataCopier(f func(interface{}) interface{}) {
+    table.Lock()
+    defer table.Unlock()
+    table.copyData = f
+}
+
+//设置缓存项被垃圾回收时执行的函数，只对之后添加的缓存项生效，nil 表示关闭
+//会增加垃圾回收的开销，只建议在排查缓存项泄漏时使用
+func (table *CacheTable) SetItemFinalizer(f func(key interface{})) {
+    table.Lock()
+    defer table.Unlock()
+    table.itemFinalizer = f
+}
+
+//设置 Value 读取缓存时检查缓存项是否有效的函数
+//返回 false 的缓存项会被删除（执行删除回调函数），并按缓存不存在处理，可以触发 loadData
+func (table *CacheTable) SetValidator(f func(*CacheItem) bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.validator = f
+}
+
+//设置保留的最近修改记录条数，0 表示不记录，修改后已有的记录被清空
+func (table *CacheTable) SetMutationLogSize(n int) {
+    table.Lock()
+    defer table.Unlock()
+    table.mutations = make([]Mutation, n)
+    table.mutationNext = 0
+    table.mutationCount = 0
+}
+
+//设置软删除的缓存项可以恢复的时长，超过时长后缓存项被真正删除
+func (table *CacheTable) SetSoftDeleteWindow(d time.Duration) {
+    table.Lock()
+    defer table.Unlock()
+    table.softDeleteWindow = d
+}
+
 //设置缓存表日志
 func (table *CacheTable) SetLogger(logger *log.Logger) {
     table.Lock()
@@ -72,11 +594,62 @@ func (table *CacheTable) SetLogger(logger *log.Logger) {
     table.logger = logger
 }
 
+//设置日志中把缓存key转换为字符串的函数，不设置时按 %v 格式输出
+func (table *CacheTable) SetKeyStringer(f func(key interface{}) string) {
+    table.Lock()
+    defer table.Unlock()
+    table.keyStringer = f
+}
+
+//设置缓存清理周期的下限，过期检查不会在 d 之内再次执行，缓存项最多会晚 d 过期
+func (table *CacheTable) SetMinCleanupInterval(d time.Duration) {
+    table.Lock()
+    defer table.Unlock()
+    table.minCleanupInterval = d
+}
+
+//设置缓存项过期时间的计算方式，对已有和之后添加的缓存项都生效，设置后立即重新检查
+//已有缓存项的创建时间和访问时间保持不变，从滑动改为绝对过期时，创建时间早于生命期的缓存项会立即被清理
+func (table *CacheTable) SetExpirationPolicy(policy ExpirationPolicy) {
+    table.Lock()
+    table.expirationPolicy = policy
+    table.Unlock()
+    table.expirationCheck()
+}
+
+//设置过期检查开始前调用的函数，返回 false 时跳过整个检查，所有缓存项都不会被清理
+//有缓存项因此没有清理时，按清理周期下限（没有设置时为 1 秒）重新安排检查
+func (table *CacheTable) SetSweepGuard(f func() bool) {
+    table.Lock()
+    defer table.Unlock()
+    table.sweepGuard = f
+}
+
+//设置过期检查中发生 panic（例如删除回调函数 panic）时调用的函数，f 在缓存表锁之外执行
+//无论是否设置，panic 都会被恢复并记录日志，过期检查按清理周期下限（没有设置时为 1 秒）重新安排
+func (table *CacheTable) SetPanicHandler(f func(recovered interface{})) {
+    table.Lock()
+    defer table.Unlock()
+    table.panicHandler = f
+}
+
 //缓存过期检查
 //代码中会去遍历所有缓存项，找到最快要被淘汰掉的缓存项的的时间作为cleanupInterval，即下一次启动缓存刷新的时间，从而保证可以及时的更新缓存，
 //可以看到其实质就是自调节下一次启动缓存更新的时间。另外我们也注意到，如果lifeSpan设置为0的话，就不会被淘汰，即永久有效
 func (table *CacheTable) expirationCheck() {
+    table.RLock()
+    sweepGuard := table.sweepGuard
+    table.RUnlock()
+    //在缓存表锁之外检查是否允许清理
+    allowed := sweepGuard == nil || sweepGuard()
+
     table.Lock()
+    //检查过程中 panic 时缓存表仍被锁定，恢复后重新安排检查，避免过期检查就此停止
+    defer func() {
+        if v := recover(); v != nil {
+            table.recoverExpirationCheck(v)
+        }
+    }()
     if table.cleanupTimer != nil {
         table.cleanupTimer.Stop()
     }
@@ -90,25 +663,62 @@ func (table *CacheTable) expirationCheck() {
     now := time.Now()
     //设置最小检查缓存过期周期为 0 
     smallestDuration := 0 * time.Second
+    //是否有缓存项因 sweepGuard 没有清理
+    skipped := false
     //循环缓存map，检查是否过期
     for key, item := range table.items {
         item.RLock()
         lifeSpan := item.lifeSpan
         accessedOn := item.accessedOn
+        remaining := item.remainingLife(table.expirationPolicy, now)
         item.RUnlock()
         //如果缓存记录的 lifeSpan 设置为0，则永久不过期
         if lifeSpan == 0 {
             continue
         }
-        if now.Sub(accessedOn) >= lifeSpan { //已过期的缓存记录，清理掉
-            table.deleteInternal(key)
+        //按上次检查时的访问时间本该过期，但之后被访问过，记为一次免于过期
+        checked := item.checkedAccessedOn
+        item.checkedAccessedOn = accessedOn
+        sliding := table.expirationPolicy == ExpireSliding
+        if sliding && !checked.IsZero() && !accessedOn.Equal(checked) && now.Sub(checked) >= lifeSpan {
+            table.keepAliveSaves++
+        }
+        if remaining <= 0 { //已过期的缓存记录，清理掉
+            if allowed {
+                table.deleteInternal(key)
+            } else {
+                skipped = true
+            }
         } else {
             //更新最小检查缓存过期周期时间
-            if smallestDuration == 0 || lifeSpan-now.Sub(accessedOn) < smallestDuration {
-                smallestDuration = lifeSpan - now.Sub(accessedOn)
+            if smallestDuration == 0 || remaining < smallestDuration {
+                smallestDuration = remaining
             }
         }
     }
+    //清理超过恢复时长的软删除缓存项
+    if allowed {
+        if d := table.purgeSoftDeleted(now); d > 0 && (smallestDuration == 0 || d < smallestDuration) {
+            smallestDuration = d
+        }
+    } else if len(table.softDeleted) > 0 {
+        skipped = true
+    }
+    //有缓存项因 sweepGuard 没有清理时，按清理周期下限（没有时为 1 秒）重新检查
+    if skipped {
+        table.log("Expiration check skipped for table", table.name)
+        retry := table.minCleanupInterval
+        if retry == 0 {
+            retry = sweepRetryInterval
+        }
+        if smallestDuration == 0 || retry < smallestDuration {
+            smallestDuration = retry
+        }
+    }
+    //检查周期不小于设置的下限
+    if smallestDuration > 0 && smallestDuration < table.minCleanupInterval {
+        smallestDuration = table.minCleanupInterval
+    }
     //更新缓存表的过期周期检查时间
     table.cleanupInterval = smallestDuration
     if smallestDuration > 0 { //smallestDuration 时长后开启单独的goroutine执行缓存过期检查
@@ -119,17 +729,60 @@ func (table *CacheTable) expirationCheck() {
     table.Unlock()
 }
 
+//处理过期检查中恢复的 panic，调用前必须锁定缓存表，返回前解锁
+func (table *CacheTable) recoverExpirationCheck(v interface{}) {
+    table.log("Expiration check panicked for table", table.name, ":", v)
+    retry := table.minCleanupInterval
+    if retry == 0 {
+        retry = sweepRetryInterval
+    }
+    table.cleanupInterval = retry
+    table.cleanupTimer = time.AfterFunc(retry, func() {
+        go table.expirationCheck()
+    })
+    panicHandler := table.panicHandler
+    table.Unlock()
+    if panicHandler != nil {
+        panicHandler(v)
+    }
+}
+
+//重新检查所有缓存项是否过期并重新安排下一次检查，用于直接修改缓存项（如 SetLifeSpan）之后
+func (table *CacheTable) RecomputeExpiration() {
+    table.expirationCheck()
+}
+
+//停止缓存过期检查定时器，缓存表从全局变量cache中删除时调用
+func (table *CacheTable) stopCleanup() {
+    table.Lock()
+    defer table.Unlock()
+    if table.cleanupTimer != nil {
+        table.cleanupTimer.Stop()
+    }
+}
+
 //添加新的缓存item，该方法包外部不可调用
 func (table *CacheTable) addInternal(item *CacheItem) {
     //注意：不要运行该方法，除非缓存表被锁定
-    table.log("Adding item with key", item.key, "and lifespan of", item.lifeSpan, "to table", table.name)
-    table.items[item.key] = item
-    expDur := table.cleanupInterval
-    addedItem := table.addedItem
-    table.Unlock()
+    var expDur time.Duration
+    var addedItem func(*CacheItem)
+    //淘汰时的删除回调函数 panic 时也要解锁缓存表
+    func() {
+        defer table.Unlock()
+        table.prepareItem(item)
+        table.log("Adding item with key", table.keyString(item.key), "and lifespan of", item.lifeSpan, "to table", table.name)
+        table.setItem(item)
+        table.recordMutation(item.key, MutationAdd)
+        table.evictOverCapacity(item)
+        table.checkLowWaterRearm()
+        expDur = table.cleanupInterval
+        addedItem = table.addedItem
+    }()
     //执行添加缓存item的回调函数
-    if table.addedItem != nil {
+    if addedItem != nil {
+        start := time.Now()
         addedItem(item)
+        table.recordCallback(CallbackAddedItem, start)
     }
     //添加完新的缓存，检查该item的生存周期，并更新缓存表table的检查缓存生存周期项 cleanupInterval
     if item.lifeSpan >0 && (expDur == 0 || item.lifeSpan < expDur) {
@@ -138,11 +791,133 @@ func (table *CacheTable) addInternal(item *CacheItem) {
 }
 
 //添加缓存
+//严格同步写入模式下写入失败时，返回的缓存项已不在缓存表中
 func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
     item := NewCacheItem(key, lifeSpan, data)
+    table.addWriteThrough(item)
+    return item
+}
+
+//添加读写生命期不同的缓存，添加和修改数据（如 Increment）后生命期为 writeSpan，读取（Value）后为 readSpan
+//过期检查使用最后一次设置的生命期
+func (table *CacheTable) AddRW(key interface{}, readSpan, writeSpan time.Duration, data interface{}) *CacheItem {
+    item := NewCacheItem(key, writeSpan, data)
+    item.readWrite = true
+    item.readSpan = readSpan
+    item.writeSpan = writeSpan
+    table.addWriteThrough(item)
+    return item
+}
+
+//添加缓存项并同步写入外部存储，返回写入的错误
+//严格同步写入模式下先写入外部存储，出错时缓存项不会添加到缓存表
+func (table *CacheTable) addWriteThrough(item *CacheItem) error {
+    table.RLock()
+    strict := table.writeThroughStrict
+    table.RUnlock()
+    if strict {
+        if err := table.writeThroughItem(item); err != nil {
+            return err
+        }
+        table.Lock()
+        table.addInternal(item)
+        return nil
+    }
     table.Lock()
     table.addInternal(item)
-    return item
+    return table.writeThroughItem(item)
+}
+
+//把缓存项同步写入外部存储，没有设置写入函数时返回 nil
+func (table *CacheTable) writeThroughItem(item *CacheItem) error {
+    table.RLock()
+    writeThrough := table.writeThrough
+    table.RUnlock()
+    if writeThrough == nil {
+        return nil
+    }
+    err := writeThrough(item.key, item.data, item.lifeSpan)
+    if err != nil {
+        table.log("Write-through failed for key", table.keyString(item.key), "in table", table.name, ":", err)
+    }
+    return err
+}
+
+//批量添加缓存项，只加锁一次，同一批中的重复key保留最后一个
+func (table *CacheTable) AddBatch(items []*CacheItem) {
+    table.AddBatchWithPolicy(items, DuplicateLastWins)
+}
+
+//批量添加缓存项，按 policy 处理同一批中的重复key，每个key只添加一个缓存项并只执行一次添加回调
+func (table *CacheTable) AddBatchWithPolicy(items []*CacheItem, policy DuplicatePolicy) error {
+    //按 policy 去掉重复key，保留的缓存项按原顺序排列
+    kept := make(map[interface{}]int, len(items))
+    for i, item := range items {
+        if _, ok := kept[item.key]; !ok || policy == DuplicateLastWins {
+            kept[item.key] = i
+        } else if policy == DuplicateError {
+            return ErrDuplicateKey
+        }
+    }
+    if len(kept) < len(items) {
+        unique := make([]*CacheItem, 0, len(kept))
+        for i, item := range items {
+            if kept[item.key] == i {
+                unique = append(unique, item)
+            }
+        }
+        items = unique
+    }
+
+    var expDur time.Duration
+    var addedItem func(*CacheItem)
+    var bulkAddedItem func([]*CacheItem)
+    //淘汰时的删除回调函数 panic 时也要解锁缓存表
+    func() {
+        table.Lock()
+        defer table.Unlock()
+        for _, item := range items {
+            table.prepareItem(item)
+            table.log("Adding item with key", table.keyString(item.key), "and lifespan of", item.lifeSpan, "to table", table.name)
+            table.setItem(item)
+            table.recordMutation(item.key, MutationAdd)
+        }
+        table.evictOverCapacity(nil)
+        table.checkLowWaterRearm()
+        expDur = table.cleanupInterval
+        addedItem = table.addedItem
+        bulkAddedItem = table.bulkAddedItem
+    }()
+    //优先执行批量回调，否则逐条执行添加回调
+    if bulkAddedItem != nil {
+        start := time.Now()
+        bulkAddedItem(items)
+        table.recordCallback(CallbackBulkAddedItem, start)
+    } else if addedItem != nil {
+        for _, item := range items {
+            start := time.Now()
+            addedItem(item)
+            table.recordCallback(CallbackAddedItem, start)
+        }
+    }
+    //只要有一条缓存项的生存周期比当前检查周期短，就重新检查一次
+    for _, item := range items {
+        if item.lifeSpan > 0 && (expDur == 0 || item.lifeSpan < expDur) {
+            table.expirationCheck()
+            break
+        }
+    }
+    return nil
+}
+
+//用生成函数批量填充缓存表，生成 n 条缓存项后通过 AddBatch 一次加锁添加
+func (table *CacheTable) Seed(n int, gen func(i int) (key interface{}, lifeSpan time.Duration, data interface{})) {
+    items := make([]*CacheItem, 0, n)
+    for i := 0; i < n; i++ {
+        key, lifeSpan, data := gen(i)
+        items = append(items, NewCacheItem(key, lifeSpan, data))
+    }
+    table.AddBatch(items)
 }
 
 //删除缓存项item, 该方法包外部不可调用
@@ -153,38 +928,337 @@ func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
     }
     //检查删除缓存项的回调函数是否为nil，不为nil,则调用回调函数
     aboutToDeleteItem := table.aboutToDeleteItem
-    table.Unlock()
-    if aboutToDeleteItem != nil {
-        aboutToDeleteItem(r)
+    table.unlocked(func() {
+        if aboutToDeleteItem != nil {
+            start := time.Now()
+            aboutToDeleteItem(r)
+            table.recordCallback(CallbackAboutToDeleteItem, start)
+        }
+        r.RLock()
+        defer r.RUnlock()
+        //检查缓存项删除回调函数是否为nil，不为nil，则调用回调函数
+        if r.aboutToExpire != nil {
+            r.aboutToExpire(key)
+        }
+    })
+    //回调期间缓存项已被替换或删除时，保留新的缓存项
+    if table.items[key] != r {
+        return r, nil
     }
     r.RLock()
     defer r.RUnlock()
-    //检查缓存项删除回调函数是否为nil，不为nil，则调用回调函数
-    if r.aboutToExpire != nil {
-        r.aboutToExpire(key)
+    table.log("Deleting item with key", table.keyString(key), "created on", r.createdOn, "and hit", r.accessCount, "times from table", table.name)
+    table.removeItem(key)
+    table.recordMutation(key, MutationDelete)
+    //剩余数量降到阈值及以下时执行回调函数，回调期间释放缓存表锁
+    remaining := len(table.items)
+    lowWater := table.lowWater
+    if lowWater != nil && !table.lowWaterFired && remaining <= table.lowWaterThreshold {
+        table.lowWaterFired = true
+        table.unlocked(func() {
+            lowWater(remaining)
+        })
     }
-    table.Lock()
-    table.log("Deleting item with key", key, "created on", r.createdOn, "and hit", r.accessCount, "times from table", table.name)
-    delete(table.items, key)
     return r, nil
 }
 
-//删除缓存项
-func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
-    table.Lock()
-    defer table.Unlock()
-    return table.deleteInternal(key)
+//在缓存表锁之外执行 f，执行完（包括 f panic 时）重新锁定缓存表，调用前必须锁定缓存表
+func (table *CacheTable) unlocked(f func()) {
+    table.Unlock()
+    defer table.Lock()
+    f()
 }
 
-//检查缓存项是否存在
-func (table *CacheTable) Exists(key interface{}) bool {
-    table.RLock()
+//缓存项数量超过上限时按淘汰策略淘汰缓存项，不淘汰 keep，调用前必须锁定缓存表
+func (table *CacheTable) evictOverCapacity(keep *CacheItem) {
+    for table.capacity > 0 && len(table.items) > table.capacity {
+        victim := table.evictionVictim(keep)
+        if victim == nil {
+            return
+        }
+        table.log("Evicting item with key", table.keyString(victim.key), "from table", table.name)
+        table.deleteInternal(victim.key)
+        table.evictions.Add(1)
+    }
+}
+
+//按淘汰策略选出要淘汰的缓存项，不选 keep，调用前必须锁定缓存表
+func (table *CacheTable) evictionVictim(keep *CacheItem) *CacheItem {
+    table.evictionMutex.Lock()
+    defer table.evictionMutex.Unlock()
+    switch table.evictionPolicy {
+    case EvictLFU:
+        h := table.lfuHeap
+        if len(h) == 0 {
+            return nil
+        }
+        if h[0] != keep {
+            return h[0]
+        }
+        //堆顶是 keep 时，次小的缓存项是它的两个子节点之一
+        var victim *CacheItem
+        for i := 1; i <= 2 && i < len(h); i++ {
+            if victim == nil || h.Less(i, victim.lfuIndex) {
+                victim = h[i]
+            }
+        }
+        return victim
+    case EvictFIFO:
+        return frontExcept(table.fifoList, keep)
+    default:
+        return frontExcept(table.lruList, keep)
+    }
+}
+
+//返回链表中第一个不是 keep 的缓存项
+func frontExcept(l *list.List, keep *CacheItem) *CacheItem {
+    for e := l.Front(); e != nil; e = e.Next() {
+        if item := e.Value.(*CacheItem); item != keep {
+            return item
+        }
+    }
+    return nil
+}
+
+//开始跟踪缓存项的淘汰顺序，调用前必须锁定 evictionMutex
+func (table *CacheTable) trackItem(item *CacheItem) {
+    item.RLock()
+    item.lfuCount = item.accessCount
+    item.lfuAccessedOn = item.accessedOn
+    item.RUnlock()
+    item.lruElem = table.lruList.PushBack(item)
+    item.fifoElem = table.fifoList.PushBack(item)
+    heap.Push(&table.lfuHeap, item)
+}
+
+//停止跟踪缓存项的淘汰顺序，调用前必须锁定 evictionMutex
+func (table *CacheTable) untrackItem(item *CacheItem) {
+    if item.lruElem == nil {
+        return
+    }
+    table.lruList.Remove(item.lruElem)
+    table.fifoList.Remove(item.fifoElem)
+    heap.Remove(&table.lfuHeap, item.lfuIndex)
+    item.lruElem = nil
+    item.fifoElem = nil
+}
+
+//按已有缓存项的添加顺序、访问时间和访问次数重建淘汰顺序，调用前必须锁定缓存表和 evictionMutex
+func (table *CacheTable) rebuildEviction() {
+    items := make([]*CacheItem, 0, len(table.items))
+    for _, item := range table.items {
+        item.RLock()
+        item.lfuCount = item.accessCount
+        item.lfuAccessedOn = item.accessedOn
+        item.RUnlock()
+        items = append(items, item)
+    }
+    table.lruList = list.New()
+    table.fifoList = list.New()
+    table.lfuHeap = make(lfuHeap, 0, len(items))
+    sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
+    for _, item := range items {
+        item.fifoElem = table.fifoList.PushBack(item)
+    }
+    sort.Slice(items, func(i, j int) bool { return items[i].lfuAccessedOn.Before(items[j].lfuAccessedOn) })
+    for _, item := range items {
+        item.lruElem = table.lruList.PushBack(item)
+        item.lfuIndex = len(table.lfuHeap)
+        table.lfuHeap = append(table.lfuHeap, item)
+    }
+    heap.Init(&table.lfuHeap)
+    table.evictionTracking.Store(true)
+}
+
+//缓存项被访问后更新它在淘汰顺序中的位置，调用前不能锁定缓存项
+func (table *CacheTable) touchEviction(item *CacheItem) {
+    if !table.evictionTracking.Load() {
+        return
+    }
+    table.evictionMutex.Lock()
+    defer table.evictionMutex.Unlock()
+    if item.lruElem == nil {
+        return
+    }
+    table.lruList.MoveToBack(item.lruElem)
+    item.RLock()
+    item.lfuCount = item.accessCount
+    item.lfuAccessedOn = item.accessedOn
+    item.RUnlock()
+    heap.Fix(&table.lfuHeap, item.lfuIndex)
+}
+
+//删除超过恢复时长的软删除缓存项并执行删除回调函数，返回距离下一个软删除缓存项到期的时长
+//调用前必须锁定缓存表
+func (table *CacheTable) purgeSoftDeleted(now time.Time) time.Duration {
+    var expired []interface{}
+    smallestDuration := 0 * time.Second
+    for key, s := range table.softDeleted {
+        left := table.softDeleteWindow - now.Sub(s.deletedOn)
+        if left <= 0 {
+            expired = append(expired, key)
+        } else if smallestDuration == 0 || left < smallestDuration {
+            smallestDuration = left
+        }
+    }
+    for _, key := range expired {
+        //回调期间释放了缓存表锁，同名缓存项可能已被恢复或重新软删除
+        if s, ok := table.softDeleted[key]; ok && now.Sub(s.deletedOn) >= table.softDeleteWindow {
+            table.purgeSoftDeletedItem(key)
+        }
+    }
+    return smallestDuration
+}
+
+//真正删除一个软删除缓存项并执行删除回调函数，回调期间释放缓存表锁，调用前必须锁定缓存表
+func (table *CacheTable) purgeSoftDeletedItem(key interface{}) {
+    r := table.softDeleted[key].item
+    delete(table.softDeleted, key)
+    aboutToDeleteItem := table.aboutToDeleteItem
+    table.unlocked(func() {
+        if aboutToDeleteItem != nil {
+            start := time.Now()
+            aboutToDeleteItem(r)
+            table.recordCallback(CallbackAboutToDeleteItem, start)
+        }
+        r.RLock()
+        defer r.RUnlock()
+        if r.aboutToExpire != nil {
+            r.aboutToExpire(key)
+        }
+    })
+    table.log("Purging soft-deleted item with key", table.keyString(key), "from table", table.name)
+}
+
+//软删除缓存项，缓存项对 Value/Exists/Count 等不再可见，在恢复时长内可以用 Undelete 恢复
+//超过恢复时长后缓存项被真正删除，此时才执行删除回调函数
+//同名缓存项已有软删除记录时，旧的缓存项先被真正删除并执行删除回调函数
+func (table *CacheTable) SoftDelete(key interface{}) error {
+    var expDur, window time.Duration
+    err := func() error {
+        //删除回调函数 panic 时也要解锁缓存表
+        table.Lock()
+        defer table.Unlock()
+        if _, ok := table.items[key]; !ok {
+            return ErrKeyNotFound
+        }
+        if _, ok := table.softDeleted[key]; ok {
+            table.purgeSoftDeletedItem(key)
+        }
+        //回调期间缓存项可能已被删除或替换
+        r, ok := table.items[key]
+        if !ok {
+            return ErrKeyNotFound
+        }
+        table.removeItem(key)
+        table.recordMutation(key, MutationDelete)
+        if table.softDeleted == nil {
+            table.softDeleted = make(map[interface{}]softDeletedItem)
+        }
+        table.softDeleted[key] = softDeletedItem{r, time.Now()}
+        expDur = table.cleanupInterval
+        window = table.softDeleteWindow
+        return nil
+    }()
+    if err != nil {
+        return err
+    }
+    //恢复时长比当前检查周期短时重新检查
+    if expDur == 0 || window < expDur {
+        table.expirationCheck()
+    }
+    return nil
+}
+
+//恢复软删除的缓存项，期间已添加同名缓存项时返回 ErrKeyExists，软删除的缓存项保持不变
+func (table *CacheTable) Undelete(key interface{}) error {
+    table.Lock()
+    defer table.Unlock()
+    s, ok := table.softDeleted[key]
+    if !ok {
+        return ErrKeyNotFound
+    }
+    if _, ok := table.items[key]; ok {
+        return ErrKeyExists
+    }
+    delete(table.softDeleted, key)
+    table.setItem(s.item)
+    table.recordMutation(key, MutationAdd)
+    return nil
+}
+
+//删除缓存项
+func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+    table.Lock()
+    defer table.Unlock()
+    return table.deleteInternal(key)
+}
+
+//缓存项仍是 r 时删除，返回是否删除
+func (table *CacheTable) deleteItem(key interface{}, r *CacheItem) bool {
+    table.Lock()
+    defer table.Unlock()
+    if table.items[key] != r {
+        return false
+    }
+    _, err := table.deleteInternal(key)
+    return err == nil
+}
+
+//对缓存表加读锁，返回内部的缓存map和解锁函数，用于热点路径上批量读取时减少加锁次数
+//调用方不能修改返回的map，必须调用解锁函数，并且在解锁前不能调用缓存表的其他会加写锁的方法
+//返回的缓存项不会更新访问时间和访问次数
+func (table *CacheTable) RLockItems() (map[interface{}]*CacheItem, func()) {
+    table.RLock()
+    return table.items, table.RUnlock
+}
+
+//设置缓存项访问次数达到 threshold 时的回调函数，回调函数只执行一次
+func (table *CacheTable) SetAccessThresholdCallback(key interface{}, threshold int64, f func(*CacheItem)) error {
+    table.RLock()
+    r, ok := table.items[key]
+    table.RUnlock()
+    if !ok {
+        return ErrKeyNotFound
+    }
+    r.SetAccessThresholdCallback(threshold, f)
+    return nil
+}
+
+//返回缓存项的副本，副本与缓存表无关，修改副本不影响缓存表，也不会更新缓存项的访问时间和访问次数
+func (table *CacheTable) CopyItem(key interface{}) (*CacheItem, bool) {
+    table.RLock()
+    r, ok := table.items[key]
+    copyData := table.copyData
+    table.RUnlock()
+    if !ok {
+        return nil, false
+    }
+    return r.copy(copyData), true
+}
+
+//检查缓存项是否存在
+func (table *CacheTable) Exists(key interface{}) bool {
+    table.RLock()
     defer table.RUnlock()
     _, ok := table.items[key]
     return ok
 }
 
+//批量检查缓存项是否存在，只加一次锁
+func (table *CacheTable) ExistsMany(keys []interface{}) map[interface{}]bool {
+    table.RLock()
+    defer table.RUnlock()
+    r := make(map[interface{}]bool, len(keys))
+    for _, key := range keys {
+        _, r[key] = table.items[key]
+    }
+    return r
+}
+
 //检查缓存项是否存在，如果不存在则添加该缓存
+//严格同步写入模式下写入失败时返回 false；写入外部存储期间缓存项被其他goroutine添加时也返回 false，
+//此时外部存储中已经是本次写入的数据
 func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
     table.Lock()
     if _, ok := table.items[key]; ok {
@@ -193,6 +1267,20 @@ func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, da
     }
     //添加进去
     item := NewCacheItem(key, lifeSpan, data)
+    if !table.writeThroughStrict {
+        table.addInternal(item)
+        table.writeThroughItem(item)
+        return true
+    }
+    table.Unlock()
+    if table.writeThroughItem(item) != nil {
+        return false
+    }
+    table.Lock()
+    if _, ok := table.items[key]; ok {
+        table.Unlock()
+        return false
+    }
     table.addInternal(item)
     return true
 }
@@ -201,37 +1289,710 @@ func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, da
 func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
     table.RLock()
     r, ok := table.items[key]
-    loadData := table.loadData
+    validator := table.validator
     table.RUnlock()
     if ok {
-        // 更新最后访问时间和总访问数量
-        r.KeepAlive()
-        return r, nil
+        if validator == nil || validator(r) {
+            // 更新最后访问时间和总访问数量
+            r.KeepAlive()
+            if r.readWrite {
+                table.checkLifeSpan(r.readSpan)
+            }
+            table.recordRead(true)
+            return r, nil
+        }
+        //缓存项已失效，删除后按缓存不存在处理，期间已被替换的新缓存项不删除
+        table.deleteItem(key, r)
     }
+    table.recordRead(false)
     // 调用回调函数
-    if loadData != nil {
-        item := loadData(key, args...)
-        if item != nil {
-            table.Add(key, item.lifeSpan, item.data)
-            return item, nil
+    item, err := table.load(key, args...)
+    if err != nil {
+        return nil, err
+    }
+    //加载的数据来自外部，不再同步写入
+    table.Lock()
+    table.addInternal(NewCacheItem(key, item.lifeSpan, item.data))
+    return item, nil
+}
+
+//获取缓存，与 Value 相同，但用 bool 表示是否找到（包括通过 loadData 加载成功），不返回错误
+func (table *CacheTable) Value2(key interface{}, args ...interface{}) (*CacheItem, bool) {
+    r, err := table.Value(key, args...)
+    return r, err == nil
+}
+
+//调用回调函数加载缓存key，加载到的缓存项不会添加到缓存表
+func (table *CacheTable) load(key interface{}, args ...interface{}) (*CacheItem, error) {
+    table.RLock()
+    loadData := table.loadData
+    loadDataE := table.loadDataE
+    loaderArgs := table.loaderArgs
+    rejectPermanent := table.rejectPermanentLoads
+    keyFilter := table.loaderKeyFilter
+    timeout := table.loaderTimeout
+    table.RUnlock()
+    if loadData == nil && loadDataE == nil {
+        return nil, ErrKeyNotFound
+    }
+    if keyFilter != nil && !keyFilter(key) {
+        return nil, ErrKeyNotFound
+    }
+    //合并默认参数，Value 传入的参数优先
+    if len(loaderArgs) > len(args) {
+        merged := make([]interface{}, len(loaderArgs))
+        copy(merged, loaderArgs)
+        copy(merged, args)
+        args = merged
+    }
+    call := func() (*CacheItem, error) {
+        if loadDataE != nil {
+            return loadDataE(key, args...)
         }
+        return loadData(key, args...), nil
+    }
+    var item *CacheItem
+    var err error
+    if timeout > 0 {
+        //超时后不再等待，缓冲通道让 loadData 返回后 goroutine 可以退出
+        type result struct {
+            item *CacheItem
+            err  error
+        }
+        done := make(chan result, 1)
+        go func() {
+            item, err := call()
+            done <- result{item, err}
+        }()
+        select {
+        case r := <-done:
+            item, err = r.item, r.err
+        case <-time.After(timeout):
+            table.log("Loading key", table.keyString(key), "in table", table.name, "timed out after", timeout)
+            return nil, ErrLoaderTimeout
+        }
+    } else {
+        item, err = call()
+    }
+    if err != nil {
+        table.RLock()
+        name := table.keyString(key)
+        table.RUnlock()
+        return nil, fmt.Errorf("Loading key %s failed: %w", name, err)
+    }
+    if item == nil {
         return nil, ErrKeyNotFoundOrLoadable
     }
-    return nil, ErrKeyNotFound
+    if rejectPermanent && item.lifeSpan == 0 {
+        return nil, ErrPermanentLoad
+    }
+    return item, nil
+}
+
+//用回调函数重新加载访问量最大的前 n 个缓存项，只替换数据和生命期，保留访问统计
+func (table *CacheTable) RefreshTop(n int64) {
+    for _, r := range table.MostAccessed(n) {
+        item, err := table.load(r.key)
+        if err != nil {
+            table.log("Refreshing item with key", table.keyString(r.key), "in table", table.name, "failed:", err)
+            continue
+        }
+        r.Lock()
+        r.setData(item.data)
+        r.lifeSpan = item.lifeSpan
+        r.Unlock()
+        //新的生命期比当前检查周期短时重新检查
+        table.checkLifeSpan(item.lifeSpan)
+    }
 }
 
-//清空缓存表
+//原子地给缓存值加上 delta 并返回新值
+//缓存值可以是任意整数类型，结果统一以 int64 类型存回缓存，结果超过 int64 范围时返回 ErrIntegerOverflow，不修改缓存值
+func (table *CacheTable) Increment(key interface{}, delta int64) (int64, error) {
+    table.RLock()
+    r, ok := table.items[key]
+    table.RUnlock()
+    if !ok {
+        return 0, ErrKeyNotFound
+    }
+    //在缓存项解锁之后执行
+    defer table.checkWriteSpan(r)
+    r.Lock()
+    defer r.Unlock()
+    n, err := toInt64(r.data)
+    if err != nil {
+        return 0, err
+    }
+    n, ok = addInt64(n, delta)
+    if !ok {
+        return 0, ErrIntegerOverflow
+    }
+    r.setData(n)
+    return n, nil
+}
+
+//原子地给缓存值加上 delta，同时把生命期设为 d 并从现在开始重新计算（绝对过期时同时重置创建时间），返回新值
+//缓存项不存在时以 delta 为值、d 为生命期创建；结果超过 int64 范围时同 Increment 返回 ErrIntegerOverflow
+func (table *CacheTable) IncrementAndTouch(key interface{}, delta int64, d time.Duration) (int64, error) {
+    table.Lock()
+    r, ok := table.items[key]
+    if !ok {
+        table.addInternal(NewCacheItem(key, d, delta))
+        return delta, nil
+    }
+    r.Lock()
+    n, err := toInt64(r.data)
+    if err != nil {
+        r.Unlock()
+        table.Unlock()
+        return 0, err
+    }
+    n, ok = addInt64(n, delta)
+    if !ok {
+        r.Unlock()
+        table.Unlock()
+        return 0, ErrIntegerOverflow
+    }
+    r.setData(n)
+    r.lifeSpan = d
+    r.touch(table.expirationPolicy, r.modifiedOn)
+    r.Unlock()
+    table.touchEviction(r)
+    expDur := table.cleanupInterval
+    table.Unlock()
+    //新的生命期比当前检查周期短时重新检查
+    if d > 0 && (expDur == 0 || d < expDur) {
+        table.expirationCheck()
+    }
+    return n, nil
+}
+
+//缓存项剩余生命期（按过期策略计算）小于 threshold 时把生命期设为 newSpan 并从现在开始重新计算，返回是否刷新
+//永久有效的缓存项不会刷新
+func (table *CacheTable) TouchIfBelow(key interface{}, threshold, newSpan time.Duration) (bool, error) {
+    table.RLock()
+    r, ok := table.items[key]
+    expDur := table.cleanupInterval
+    policy := table.expirationPolicy
+    table.RUnlock()
+    if !ok {
+        return false, ErrKeyNotFound
+    }
+    r.Lock()
+    now := time.Now()
+    if r.lifeSpan == 0 || r.remainingLife(policy, now) >= threshold {
+        r.Unlock()
+        return false, nil
+    }
+    r.lifeSpan = newSpan
+    r.touch(policy, now)
+    r.Unlock()
+    table.touchEviction(r)
+    //新的生命期比当前检查周期短时重新检查
+    if newSpan > 0 && (expDur == 0 || newSpan < expDur) {
+        table.expirationCheck()
+    }
+    return true, nil
+}
+
+//原子地读取缓存数据，用 fn 计算新数据后写回，同时把生命期设为 lifeSpan 并从现在开始重新计算
+//fn 在缓存表锁内执行，不能调用缓存表的方法
+//缓存项不存在时返回 ErrKeyNotFound，除非通过 SetUpdateFuncCreates 允许创建
+func (table *CacheTable) UpdateFunc(key interface{}, lifeSpan time.Duration, fn func(old interface{}) interface{}) (*CacheItem, error) {
+    table.Lock()
+    r, ok := table.items[key]
+    if !ok {
+        if !table.updateFuncCreates {
+            table.Unlock()
+            return nil, ErrKeyNotFound
+        }
+        r = NewCacheItem(key, lifeSpan, fn(nil))
+        table.addInternal(r)
+        return r, nil
+    }
+    r.Lock()
+    r.setData(fn(r.data))
+    r.lifeSpan = lifeSpan
+    r.touch(table.expirationPolicy, r.modifiedOn)
+    r.Unlock()
+    table.touchEviction(r)
+    expDur := table.cleanupInterval
+    table.Unlock()
+    //新的生命期比当前检查周期短时重新检查
+    if lifeSpan > 0 && (expDur == 0 || lifeSpan < expDur) {
+        table.expirationCheck()
+    }
+    return r, nil
+}
+
+//原子地给缓存值加上 delta，结果不超过 max，capped 表示是否被截断为 max
+//缓存值的类型要求同 Increment，结果小于 int64 最小值时返回 ErrIntegerOverflow
+func (table *CacheTable) IncrementBounded(key interface{}, delta, max int64) (int64, bool, error) {
+    table.RLock()
+    r, ok := table.items[key]
+    table.RUnlock()
+    if !ok {
+        return 0, false, ErrKeyNotFound
+    }
+    //在缓存项解锁之后执行
+    defer table.checkWriteSpan(r)
+    r.Lock()
+    defer r.Unlock()
+    n, err := toInt64(r.data)
+    if err != nil {
+        return 0, false, err
+    }
+    n, ok = addInt64(n, delta)
+    if !ok && delta < 0 {
+        return 0, false, ErrIntegerOverflow
+    }
+    //超过 int64 范围时一定超过 max
+    capped := false
+    if !ok || n > max {
+        n = max
+        capped = true
+    }
+    r.setData(n)
+    return n, capped, nil
+}
+
+//重置缓存项的生命周期，并重新计算缓存过期检查时间
+func (table *CacheTable) Rebirth(key interface{}) error {
+    table.RLock()
+    r, ok := table.items[key]
+    table.RUnlock()
+    if !ok {
+        return ErrKeyNotFound
+    }
+    r.Rebirth()
+    table.expirationCheck()
+    return nil
+}
+
+//对缓存key加互斥锁，返回解锁函数
+//该锁只是建议锁，不影响缓存表的其他操作，用于让多个goroutine串行处理同一个缓存key
+func (table *CacheTable) LockKey(key interface{}) (unlock func()) {
+    table.keyLocksMutex.Lock()
+    if table.keyLocks == nil {
+        table.keyLocks = make(map[interface{}]*keyLock)
+    }
+    l, ok := table.keyLocks[key]
+    if !ok {
+        l = &keyLock{}
+        table.keyLocks[key] = l
+    }
+    l.refs++
+    table.keyLocksMutex.Unlock()
+
+    l.Lock()
+    return func() {
+        l.Unlock()
+        table.keyLocksMutex.Lock()
+        l.refs--
+        if l.refs == 0 {
+            delete(table.keyLocks, key)
+        }
+        table.keyLocksMutex.Unlock()
+    }
+}
+
+//返回创建时间在 [start, end] 范围内的缓存项
+func (table *CacheTable) CreatedBetween(start, end time.Time) []*CacheItem {
+    table.RLock()
+    defer table.RUnlock()
+    var r []*CacheItem
+    for _, item := range table.items {
+        createdOn := item.CreatedOn()
+        if !createdOn.Before(start) && !createdOn.After(end) {
+            r = append(r, item)
+        }
+    }
+    return r
+}
+
+//查找缓存值相等的缓存项，返回每组相等缓存值对应的key，只返回包含两个以上key的组
+//eq 为 nil 时使用 reflect.DeepEqual 比较
+func (table *CacheTable) FindDuplicates(eq func(a, b interface{}) bool) [][]interface{} {
+    if eq == nil {
+        eq = reflect.DeepEqual
+    }
+    table.RLock()
+    defer table.RUnlock()
+    //每组保存第一个缓存值用于比较
+    var groups [][]interface{}
+    var values []interface{}
+    for key, item := range table.items {
+        data := item.Data()
+        found := false
+        for i, value := range values {
+            if eq(value, data) {
+                groups[i] = append(groups[i], key)
+                found = true
+                break
+            }
+        }
+        if !found {
+            groups = append(groups, []interface{}{key})
+            values = append(values, data)
+        }
+    }
+    var r [][]interface{}
+    for _, g := range groups {
+        if len(g) > 1 {
+            r = append(r, g)
+        }
+    }
+    return r
+}
+
+//返回最近的 n 条修改记录，按发生顺序排列
+func (table *CacheTable) MutationLog(n int) []Mutation {
+    table.RLock()
+    defer table.RUnlock()
+    if n > table.mutationCount {
+        n = table.mutationCount
+    }
+    r := make([]Mutation, n)
+    size := len(table.mutations)
+    for i := 0; i < n; i++ {
+        r[i] = table.mutations[(table.mutationNext-n+i+size)%size]
+    }
+    return r
+}
+
+//返回数据在 t 之后被添加或修改过的缓存项
+func (table *CacheTable) ModifiedSince(t time.Time) []*CacheItem {
+    table.RLock()
+    defer table.RUnlock()
+    var r []*CacheItem
+    for _, item := range table.items {
+        if item.ModifiedOn().After(t) {
+            r = append(r, item)
+        }
+    }
+    return r
+}
+
+//把所有缓存项的生命期设为 d，返回修改的缓存项数量，d 为 0 时所有缓存项变为永久有效
+//修改后重新计算缓存过期检查时间
+func (table *CacheTable) SetAllLifeSpans(d time.Duration) int {
+    table.Lock()
+    for _, item := range table.items {
+        item.Lock()
+        item.lifeSpan = d
+        item.Unlock()
+    }
+    n := len(table.items)
+    table.Unlock()
+    table.expirationCheck()
+    return n
+}
+
+//返回缓存表中所有类型为 T 的缓存数据，以及数据不是 T 类型的缓存key
+func AllTyped[T any](table *CacheTable) ([]T, []interface{}) {
+    table.RLock()
+    defer table.RUnlock()
+    var r []T
+    var mismatched []interface{}
+    for key, item := range table.items {
+        item.RLock()
+        data, ok := item.data.(T)
+        item.RUnlock()
+        if ok {
+            r = append(r, data)
+        } else {
+            mismatched = append(mismatched, key)
+        }
+    }
+    return r, mismatched
+}
+
+//对缓存表中的每个缓存项执行 fn，收集 fn 返回 true 时的结果
+//先在锁内复制缓存项列表，fn 在锁外执行，可以调用缓存表的方法
+func Collect[T any](table *CacheTable, fn func(item *CacheItem) (T, bool)) []T {
+    table.RLock()
+    items := make([]*CacheItem, 0, len(table.items))
+    for _, item := range table.items {
+        items = append(items, item)
+    }
+    table.RUnlock()
+    var r []T
+    for _, item := range items {
+        if v, ok := fn(item); ok {
+            r = append(r, v)
+        }
+    }
+    return r
+}
+
+//返回每种回调函数（CallbackAddedItem 等）的执行次数和耗时，没有执行过的回调函数不包括在内
+func (table *CacheTable) CallbackDurations() map[string]CallbackDuration {
+    table.callbackDurationsMutex.Lock()
+    defer table.callbackDurationsMutex.Unlock()
+    r := make(map[string]CallbackDuration, len(table.callbackDurations))
+    for name, c := range table.callbackDurations {
+        r[name] = c
+    }
+    return r
+}
+
+//Prometheus 标签值需要转义的字符
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//设置计算缓存数据字节数的函数，设置后 WriteMetrics 输出缓存数据的总字节数
+//缓存项不记录自己的大小，每次输出时对所有缓存数据调用 f
+func (table *CacheTable) SetSizeFunc(f func(data interface{}) int64) {
+    table.Lock()
+    defer table.Unlock()
+    table.sizeFunc = f
+}
+
+//返回所有缓存数据的总字节数，没有设置 sizeFunc 时 ok 为 false
+func (table *CacheTable) bytes() (int64, bool) {
+    table.RLock()
+    defer table.RUnlock()
+    if table.sizeFunc == nil {
+        return 0, false
+    }
+    total := int64(0)
+    for _, item := range table.items {
+        item.RLock()
+        total += table.sizeFunc(item.data)
+        item.RUnlock()
+    }
+    return total, true
+}
+
+//以 Prometheus 文本格式输出缓存表的命中、没有命中、淘汰次数、缓存项数量和缓存数据字节数，prefix 为空时使用 cache2go
+//每个指标带有 table 标签，值为缓存表名字；字节数需要先通过 SetSizeFunc 设置计算函数，没有设置时不输出
+func (table *CacheTable) WriteMetrics(w io.Writer, prefix string) error {
+    if prefix == "" {
+        prefix = "cache2go"
+    }
+    label := metricLabelEscaper.Replace(table.name)
+    type metric struct {
+        name  string
+        kind  string
+        value int64
+    }
+    metrics := []metric{
+        {"hits_total", "counter", table.hits.Load()},
+        {"misses_total", "counter", table.misses.Load()},
+        {"evictions_total", "counter", table.evictions.Load()},
+        {"items", "gauge", table.count.Load()},
+    }
+    if n, ok := table.bytes(); ok {
+        metrics = append(metrics, metric{"bytes", "gauge", n})
+    }
+    for _, m := range metrics {
+        _, err := fmt.Fprintf(w, "# TYPE %s_%s %s\n%s_%s{table=\"%s\"} %d\n", prefix, m.name, m.kind, prefix, m.name, label, m.value)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//返回最近 window 时长内 Value 调用直接从缓存命中的比例，没有调用时返回 0
+//只保留最近 1024 次调用的结果，调用频繁时实际统计的时长可能小于 window
+func (table *CacheTable) RecentHitRatio(window time.Duration) float64 {
+    table.recentReadsMutex.Lock()
+    defer table.recentReadsMutex.Unlock()
+    since := time.Now().Add(-window)
+    hits, total := 0, 0
+    for i := 1; i <= table.recentReadsCount; i++ {
+        read := table.recentReads[(table.recentReadsNext-i+recentReadsSize)%recentReadsSize]
+        if read.at.Before(since) {
+            break
+        }
+        total++
+        if read.hit {
+            hits++
+        }
+    }
+    if total == 0 {
+        return 0
+    }
+    return float64(hits) / float64(total)
+}
+
+//返回缓存数据类型的分布，key 为 reflect.TypeOf(data).String()，值为该类型的缓存项数量
+func (table *CacheTable) ValueTypes() map[string]int {
+    table.RLock()
+    defer table.RUnlock()
+    r := make(map[string]int)
+    for _, item := range table.items {
+        //nil 数据没有类型
+        name := "<nil>"
+        if t := reflect.TypeOf(item.Data()); t != nil {
+            name = t.String()
+        }
+        r[name]++
+    }
+    return r
+}
+
+//按添加顺序返回所有缓存项，同一个key再次添加时按最后一次添加的顺序
+func (table *CacheTable) ItemsInInsertionOrder() []*CacheItem {
+    table.RLock()
+    defer table.RUnlock()
+    r := make([]*CacheItem, 0, len(table.items))
+    for _, item := range table.items {
+        r = append(r, item)
+    }
+    sort.Slice(r, func(i, j int) bool { return r[i].seq < r[j].seq })
+    return r
+}
+
+//用缓存表的随机数源随机抽取 fraction 比例的缓存key，fraction 取值 0 到 1
+//缓存key先按字符串形式排序再抽取，缓存内容和随机数种子相同时结果相同
+func (table *CacheTable) SampleKeys(fraction float64) []interface{} {
+    table.Lock()
+    defer table.Unlock()
+    if fraction <= 0 {
+        return nil
+    }
+    if fraction > 1 {
+        fraction = 1
+    }
+    keys := make([]interface{}, 0, len(table.items))
+    names := make(map[interface{}]string, len(table.items))
+    for key := range table.items {
+        keys = append(keys, key)
+        names[key] = table.keyString(key)
+    }
+    sort.Slice(keys, func(i, j int) bool { return names[keys[i]] < names[keys[j]] })
+    n := int(fraction*float64(len(keys)) + 0.5)
+    rnd := table.random()
+    rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+    return keys[:n]
+}
+
+//清空缓存表，不执行删除回调函数
 func (table *CacheTable) Flush() {
     table.Lock()
     defer table.Unlock()
     table.log("Flushing table", table.name)
+    if table.evictionTracking.Load() {
+        table.evictionMutex.Lock()
+        for _, item := range table.items {
+            table.untrackItem(item)
+        }
+        table.evictionMutex.Unlock()
+    }
     table.items = make(map[interface{}]*CacheItem)
+    table.count.Store(0)
     table.cleanupInterval = 0
     if table.cleanupTimer != nil {
         table.cleanupTimer.Stop()
     }
 }
 
+//清空缓存表，清空前对每条缓存项执行 aboutToDeleteItem 和 aboutToExpire 回调函数
+//回调函数执行期间新添加的缓存项会保留
+func (table *CacheTable) FlushCallbacks() {
+    table.Lock()
+    table.log("Flushing table", table.name, "with callbacks")
+    items := make(map[interface{}]*CacheItem, len(table.items))
+    for key, item := range table.items {
+        items[key] = item
+    }
+    aboutToDeleteItem := table.aboutToDeleteItem
+    table.Unlock()
+
+    for key, item := range items {
+        if aboutToDeleteItem != nil {
+            start := time.Now()
+            aboutToDeleteItem(item)
+            table.recordCallback(CallbackAboutToDeleteItem, start)
+        }
+        item.RLock()
+        aboutToExpire := item.aboutToExpire
+        item.RUnlock()
+        if aboutToExpire != nil {
+            aboutToExpire(key)
+        }
+    }
+
+    table.Lock()
+    defer table.Unlock()
+    for key, item := range items {
+        if table.items[key] == item {
+            table.removeItem(key)
+        }
+    }
+    if len(table.items) == 0 {
+        table.cleanupInterval = 0
+        if table.cleanupTimer != nil {
+            table.cleanupTimer.Stop()
+        }
+    }
+}
+
+//删除所有会过期（lifeSpan 大于 0）的缓存项，保留永久缓存项，返回删除的数量
+//删除时执行删除回调函数，删除后重新计算缓存过期检查时间
+func (table *CacheTable) FlushExpiring() int {
+    table.Lock()
+    var keys []interface{}
+    for key, item := range table.items {
+        item.RLock()
+        if item.lifeSpan > 0 {
+            keys = append(keys, key)
+        }
+        item.RUnlock()
+    }
+    n := 0
+    for _, key := range keys {
+        if _, err := table.deleteInternal(key); err == nil {
+            n++
+        }
+    }
+    table.Unlock()
+    table.expirationCheck()
+    return n
+}
+
+//带读取拦截函数的缓存表，Value、Value2、Exists 和 ExistsMany 的结果会通知拦截函数，其他方法与原缓存表相同
+type ReadInterceptedTable struct {
+    *CacheTable
+    intercept func(key interface{}, hit bool)
+}
+
+//返回带读取拦截函数的缓存表，不改变原缓存表的行为，可以为同一个缓存表创建多个
+func (table *CacheTable) WithReadInterceptor(fn func(key interface{}, hit bool)) *ReadInterceptedTable {
+    return &ReadInterceptedTable{table, fn}
+}
+
+//获取缓存，通过 loadData 加载成功也算命中
+func (table *ReadInterceptedTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+    r, err := table.CacheTable.Value(key, args...)
+    table.intercept(key, err == nil)
+    return r, err
+}
+
+//获取缓存，与 Value 相同，但用 bool 表示是否找到
+func (table *ReadInterceptedTable) Value2(key interface{}, args ...interface{}) (*CacheItem, bool) {
+    r, ok := table.CacheTable.Value2(key, args...)
+    table.intercept(key, ok)
+    return r, ok
+}
+
+//检查缓存项是否存在
+func (table *ReadInterceptedTable) Exists(key interface{}) bool {
+    ok := table.CacheTable.Exists(key)
+    table.intercept(key, ok)
+    return ok
+}
+
+//批量检查缓存项是否存在，每个key通知一次拦截函数
+func (table *ReadInterceptedTable) ExistsMany(keys []interface{}) map[interface{}]bool {
+    r := table.CacheTable.ExistsMany(keys)
+    for _, key := range keys {
+        table.intercept(key, r[key])
+    }
+    return r
+}
+
 //提供访问最多的前几个缓存项，CacheItemPair有缓存的key和AccessCount组成
 //CacheItemPairList则是CacheItemPair组成的Slice，且实现了Sort接口。
 type CacheItemPair struct {
@@ -245,15 +2006,39 @@ func (p CacheItemPairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p CacheItemPairList) Len() int           { return len(p) }
 func (p CacheItemPairList) Less(i, j int) bool { return p[i].AccessCount > p[j].AccessCount }
 
+//返回所有缓存项的访问次数之和，超过 int64 范围时返回 math.MaxInt64
+func (table *CacheTable) TotalAccessCount() int64 {
+    table.RLock()
+    defer table.RUnlock()
+    total := int64(0)
+    for _, item := range table.items {
+        item.RLock()
+        n := item.accessCount
+        item.RUnlock()
+        if total > math.MaxInt64-n {
+            return math.MaxInt64
+        }
+        total += n
+    }
+    return total
+}
+
 //返回访问量最大的前 count 个缓存项
 func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
     table.RLock()
     defer table.RUnlock()
-    //创建变量p为 CacheItemPairList类型 长度为整个缓存表table的缓存记录数
-    p := make(CacheItemPairList, len(table.items))
+    //创建变量p为 CacheItemPairList类型 长度为整个缓存表table的缓存记录数，不超过 maxAnalysisItems
+    n := len(table.items)
+    if table.maxAnalysisItems > 0 && n > table.maxAnalysisItems {
+        n = table.maxAnalysisItems
+    }
+    p := make(CacheItemPairList, n)
     i := 0
     //初始化变量 p
     for k, v := range table.items {
+        if i >= n {
+            break
+        }
         p[i] = CacheItemPair{k, v.accessCount}
         i++
     }
@@ -274,34 +2059,247 @@ func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
     return r
 }
 
-//记录缓存
-func (table *CacheTable) log(v ...interface{}) {
-    if table.logger == nil {
-        return
-    }
-    table.logger.Println(v)
+//提供最近访问的前几个缓存项，CacheItemAccessPair由缓存的key和上次访问时间组成
+//CacheItemAccessPairList实现了Sort接口，按访问时间从近到远排序
+type CacheItemAccessPair struct {
+    Key        interface{}
+    AccessedOn time.Time
 }
 
+type CacheItemAccessPairList []CacheItemAccessPair
 
+func (p CacheItemAccessPairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p CacheItemAccessPairList) Len() int           { return len(p) }
+func (p CacheItemAccessPairList) Less(i, j int) bool { return p[i].AccessedOn.After(p[j].AccessedOn) }
 
+//返回最近访问的前 count 个缓存项，按上次访问时间从近到远排列，count 小于等于 0 时返回 nil
+func (table *CacheTable) MostRecentlyAccessed(count int) []*CacheItem {
+    if count <= 0 {
+        return nil
+    }
+    table.RLock()
+    defer table.RUnlock()
+    //检查的缓存项不超过 maxAnalysisItems
+    n := len(table.items)
+    if table.maxAnalysisItems > 0 && n > table.maxAnalysisItems {
+        n = table.maxAnalysisItems
+    }
+    p := make(CacheItemAccessPairList, 0, n)
+    for k, v := range table.items {
+        if len(p) >= n {
+            break
+        }
+        v.RLock()
+        p = append(p, CacheItemAccessPair{k, v.accessedOn})
+        v.RUnlock()
+    }
+    sort.Sort(p)
+    if count < len(p) {
+        p = p[:count]
+    }
+    r := make([]*CacheItem, 0, len(p))
+    for _, v := range p {
+        r = append(r, table.items[v.Key])
+    }
+    return r
+}
 
+//新缓存项添加到缓存表之前共享缓存数据并执行初始化函数，调用前必须锁定缓存表
+func (table *CacheTable) prepareItem(item *CacheItem) {
+    item.seq = table.nextSeq
+    table.nextSeq++
+    if table.accessHistorySize > 0 {
+        item.Lock()
+        item.accessHistory = make([]time.Time, table.accessHistorySize)
+        item.accessHistoryNext = 0
+        item.accessHistoryCount = 0
+        item.Unlock()
+    }
+    if table.valueInterner != nil {
+        item.data = table.valueInterner(item.data)
+    }
+    if table.itemInitializer != nil {
+        table.itemInitializer(item)
+    }
+}
 
+//把缓存项放入缓存表并维护缓存记录条数，调用前必须锁定缓存表
+func (table *CacheTable) setItem(item *CacheItem) {
+    old, ok := table.items[item.key]
+    if !ok {
+        table.count.Add(1)
+    }
+    table.items[item.key] = item
+    item.Lock()
+    item.table = table
+    item.Unlock()
+    if table.evictionTracking.Load() {
+        table.evictionMutex.Lock()
+        if ok {
+            table.untrackItem(old)
+        }
+        table.untrackItem(item)
+        table.trackItem(item)
+        table.evictionMutex.Unlock()
+    }
+    if f := table.itemFinalizer; f != nil {
+        runtime.SetFinalizer(item, nil)
+        runtime.SetFinalizer(item, func(item *CacheItem) {
+            f(item.key)
+        })
+    }
+}
 
+//从缓存表中删除缓存项并维护缓存记录条数，调用前必须锁定缓存表
+func (table *CacheTable) removeItem(key interface{}) {
+    if r, ok := table.items[key]; ok {
+        table.count.Add(-1)
+        delete(table.items, key)
+        if table.evictionTracking.Load() {
+            table.evictionMutex.Lock()
+            table.untrackItem(r)
+            table.evictionMutex.Unlock()
+        }
+    }
+}
 
+//生命期比当前检查周期短时重新检查，调用前不能锁定缓存表和缓存项
+func (table *CacheTable) checkLifeSpan(lifeSpan time.Duration) {
+    table.RLock()
+    expDur := table.cleanupInterval
+    table.RUnlock()
+    if lifeSpan > 0 && (expDur == 0 || lifeSpan < expDur) {
+        table.expirationCheck()
+    }
+}
 
+//通过 AddRW 添加的缓存项修改数据后生命期变为 writeSpan，需要时重新检查
+func (table *CacheTable) checkWriteSpan(item *CacheItem) {
+    if item.readWrite {
+        table.touchEviction(item)
+        table.checkLifeSpan(item.writeSpan)
+    }
+}
 
+//缓存项数量回到低水位阈值以上时重新允许执行低水位回调函数，调用前必须锁定缓存表
+func (table *CacheTable) checkLowWaterRearm() {
+    if len(table.items) > table.lowWaterThreshold {
+        table.lowWaterFired = false
+    }
+}
 
+//记录一次 Value 调用的结果
+func (table *CacheTable) recordRead(hit bool) {
+    if hit {
+        table.hits.Add(1)
+    } else {
+        table.misses.Add(1)
+    }
+    table.recentReadsMutex.Lock()
+    defer table.recentReadsMutex.Unlock()
+    if table.recentReads == nil {
+        table.recentReads = make([]recentRead, recentReadsSize)
+    }
+    table.recentReads[table.recentReadsNext] = recentRead{time.Now(), hit}
+    table.recentReadsNext = (table.recentReadsNext + 1) % recentReadsSize
+    if table.recentReadsCount < recentReadsSize {
+        table.recentReadsCount++
+    }
+}
 
+//记录一次从 start 开始的回调函数执行耗时
+func (table *CacheTable) recordCallback(name string, start time.Time) {
+    d := time.Since(start)
+    table.callbackDurationsMutex.Lock()
+    defer table.callbackDurationsMutex.Unlock()
+    if table.callbackDurations == nil {
+        table.callbackDurations = make(map[string]CallbackDuration)
+    }
+    c := table.callbackDurations[name]
+    c.Calls++
+    c.Total += d
+    if d > c.Max {
+        c.Max = d
+    }
+    table.callbackDurations[name] = c
+}
 
+//记录一条修改，调用前必须锁定缓存表
+func (table *CacheTable) recordMutation(key interface{}, op string) {
+    size := len(table.mutations)
+    if size == 0 {
+        return
+    }
+    table.mutations[table.mutationNext] = Mutation{key, op, time.Now()}
+    table.mutationNext = (table.mutationNext + 1) % size
+    if table.mutationCount < size {
+        table.mutationCount++
+    }
+}
 
+//返回缓存表的随机数生成器，调用前必须锁定缓存表
+func (table *CacheTable) random() *rand.Rand {
+    if table.rnd == nil {
+        table.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+    }
+    return table.rnd
+}
 
+//记录缓存
+func (table *CacheTable) log(v ...interface{}) {
+    if table.logger == nil {
+        return
+    }
+    table.logger.Println(v...)
+}
 
+//把缓存key转换为日志中使用的字符串
+func (table *CacheTable) keyString(key interface{}) string {
+    if table.keyStringer != nil {
+        return table.keyStringer(key)
+    }
+    return fmt.Sprintf("%v", key)
+}
 
+//把整数类型的缓存值转换为 int64，不是整数时返回 ErrNotInteger，超过 int64 范围时返回 ErrIntegerOverflow
+func toInt64(data interface{}) (int64, error) {
+    switch n := data.(type) {
+    case int:
+        return int64(n), nil
+    case int8:
+        return int64(n), nil
+    case int16:
+        return int64(n), nil
+    case int32:
+        return int64(n), nil
+    case int64:
+        return n, nil
+    case uint:
+        return uint64ToInt64(uint64(n))
+    case uint8:
+        return int64(n), nil
+    case uint16:
+        return int64(n), nil
+    case uint32:
+        return int64(n), nil
+    case uint64:
+        return uint64ToInt64(n)
+    }
+    return 0, ErrNotInteger
+}
 
+//把 uint64 转换为 int64，超过 int64 范围时返回 ErrIntegerOverflow
+func uint64ToInt64(n uint64) (int64, error) {
+    if n > math.MaxInt64 {
+        return 0, ErrIntegerOverflow
+    }
+    return int64(n), nil
+}
 
-
-
-
-
-
-
+//返回 a+b，结果超过 int64 范围时 ok 为 false
+func addInt64(a, b int64) (int64, bool) {
+    if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+        return 0, false
+    }
+    return a + b, true
+}
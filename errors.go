@@ -7,4 +7,10 @@ import (
 var (
     ErrKeyNotFound = errors.New("Key not found in cache")
     ErrKeyNotFoundOrLoadable = errors.New("Key not found and could not be loaded into cache")
+    ErrNotInteger = errors.New("Cached data is not an integer")
+    ErrIntegerOverflow = errors.New("Cached integer does not fit in int64")
+    ErrPermanentLoad = errors.New("Data loader returned a permanent item")
+    ErrDuplicateKey = errors.New("Duplicate key in batch")
+    ErrLoaderTimeout = errors.New("Data loader timed out")
+    ErrKeyExists = errors.New("Key already exists in cache")
 )
\ No newline at end of file